@@ -0,0 +1,201 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// minAuditLength is the minimum length of an identifier or string literal for
+// "garble audit" to look for it. Shorter strings are far too likely to show up
+// in a binary by chance, such as in the standard library.
+const minAuditLength = 5
+
+// auditNeedle is a string we do not want to find in an obfuscated binary.
+type auditNeedle struct {
+	kind  string // e.g. "package path" or "identifier"
+	value string
+}
+
+// auditHit is an occurrence of an auditNeedle in a binary.
+type auditHit struct {
+	section string
+	offset  uint64
+	needle  auditNeedle
+}
+
+// commandAudit implements "garble audit".
+func commandAudit(args []string) error {
+	flags, args := splitFlagsFromArgs(args)
+	if len(args) < 1 {
+		return fmt.Errorf("usage: garble [flags] audit [build flags] binary [packages]")
+	}
+	binPath, patterns := args[0], args[1:]
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+
+	// Load the same list of packages that a build would use.
+	if err := setOptions(); err != nil {
+		return err
+	}
+	cache.BuildFlags = filterBuildFlags(flags)
+	if err := setGoPrivate(); err != nil {
+		return err
+	}
+	if err := setListedPackages(patterns); err != nil {
+		return err
+	}
+
+	needles, err := auditNeedles()
+	if err != nil {
+		return err
+	}
+
+	f, err := elf.Open(binPath)
+	if err != nil {
+		return fmt.Errorf("only ELF binaries are supported: %v", err)
+	}
+	defer f.Close()
+
+	var hits []auditHit
+	for _, section := range f.Sections {
+		switch section.Type {
+		case elf.SHT_NOBITS, elf.SHT_SYMTAB, elf.SHT_DYNSYM, elf.SHT_STRTAB:
+			// No data, or symbol tables; -s removes the latter.
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return err
+		}
+		sectionStart := len(hits)
+		for _, needle := range needles {
+			value := []byte(needle.value)
+			for off := 0; ; {
+				i := bytes.Index(data[off:], value)
+				if i < 0 {
+					break
+				}
+				hits = append(hits, auditHit{
+					section: section.Name,
+					offset:  uint64(off + i),
+					needle:  needle,
+				})
+				off += i + len(value)
+			}
+		}
+		sectionHits := hits[sectionStart:]
+		sort.SliceStable(sectionHits, func(i, j int) bool {
+			return sectionHits[i].offset < sectionHits[j].offset
+		})
+	}
+
+	for _, hit := range hits {
+		fmt.Printf("%s+0x%x: %s %q\n", hit.section, hit.offset, hit.needle.kind, hit.needle.value)
+	}
+	if len(hits) > 0 {
+		return fmt.Errorf("found %d leaks of private information in %s", len(hits), binPath)
+	}
+	return nil
+}
+
+// auditNeedles collects the strings which should not be present in a binary
+// obfuscated from the listed packages: the paths, file names, and top-level
+// identifiers of private packages. If -literals is used, their string literals
+// are included too.
+//
+// Identifiers are qualified, as they are in symbol names like "pkg/path.Func"
+// and type names like "pkg.Type". On their own, common names like Reader would
+// also be found in the standard library.
+func auditNeedles() ([]auditNeedle, error) {
+	seen := make(map[auditNeedle]bool)
+	var needles []auditNeedle
+	add := func(kind, value string) {
+		needle := auditNeedle{kind, value}
+		if len(value) < minAuditLength || seen[needle] {
+			return
+		}
+		seen[needle] = true
+		needles = append(needles, needle)
+	}
+
+	fset := token.NewFileSet()
+	for _, pkg := range cache.ListedPackages {
+		if !pkg.private {
+			continue
+		}
+		add("package path", pkg.ImportPath)
+		symPrefix := pkg.ImportPath + "."
+		if pkg.Name == "main" {
+			symPrefix = "main."
+		}
+		for _, goFile := range pkg.GoFiles {
+			// With -trimpath, file names show up as "pkgpath/file.go".
+			add("file name", path.Join(pkg.ImportPath, goFile))
+
+			file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, goFile), nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, decl := range file.Decls {
+				switch decl := decl.(type) {
+				case *ast.FuncDecl:
+					switch name := decl.Name.Name; {
+					case decl.Recv != nil:
+						// Exported methods are never obfuscated.
+					case name == "main", name == "init":
+					default:
+						add("identifier", symPrefix+name)
+					}
+				case *ast.GenDecl:
+					for _, spec := range decl.Specs {
+						switch spec := spec.(type) {
+						case *ast.TypeSpec:
+							add("identifier", symPrefix+spec.Name.Name)
+							add("identifier", pkg.Name+"."+spec.Name.Name)
+						case *ast.ValueSpec:
+							for _, name := range spec.Names {
+								add("identifier", symPrefix+name.Name)
+							}
+						}
+					}
+				}
+			}
+			if !opts.GarbleLiterals {
+				continue
+			}
+			ast.Inspect(file, func(node ast.Node) bool {
+				switch node := node.(type) {
+				case *ast.ImportSpec, *ast.Field:
+					return false // import paths and struct tags
+				case *ast.BasicLit:
+					if node.Kind != token.STRING {
+						break
+					}
+					if value, err := strconv.Unquote(node.Value); err == nil {
+						add("string literal", value)
+					}
+				}
+				return true
+			})
+		}
+	}
+	sort.Slice(needles, func(i, j int) bool {
+		if needles[i].kind != needles[j].kind {
+			return needles[i].kind < needles[j].kind
+		}
+		return needles[i].value < needles[j].value
+	})
+	return needles, nil
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync/atomic"
 	"testing"
 )
@@ -29,14 +30,7 @@ func BenchmarkBuild(b *testing.B) {
 	}
 	defer os.RemoveAll(tdir)
 
-	garbleBin := filepath.Join(tdir, "garble")
-	if runtime.GOOS == "windows" {
-		garbleBin += ".exe"
-	}
-
-	if err := exec.Command("go", "build", "-o="+garbleBin).Run(); err != nil {
-		b.Fatalf("building garble: %v", err)
-	}
+	garbleBin := buildGarble(b, tdir)
 
 	// We collect extra metrics.
 	var n, userTime, systemTime int64
@@ -62,3 +56,46 @@ func BenchmarkBuild(b *testing.B) {
 	}
 	b.ReportMetric(float64(info.Size()), "bin-B")
 }
+
+// BenchmarkLiterals measures the run-time overhead of each -literals level.
+// The benchmark program is built once per level, and then run with b.N
+// iterations of a loop which uses a few literals.
+func BenchmarkLiterals(b *testing.B) {
+	tdir, err := ioutil.TempDir("", "garble-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	garbleBin := buildGarble(b, tdir)
+
+	for _, level := range []string{"false", "fast", "balanced", "strong"} {
+		level := level
+		b.Run(level, func(b *testing.B) {
+			benchBin := filepath.Join(tdir, "bench-"+level)
+			cmd := exec.Command(garbleBin, "-literals="+level, "build", "-o="+benchBin, "./testdata/bench")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				b.Fatalf("%v: %s", err, out)
+			}
+
+			b.ResetTimer()
+			cmd = exec.Command(benchBin, strconv.Itoa(b.N))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				b.Fatalf("%v: %s", err, out)
+			}
+		})
+	}
+}
+
+// buildGarble builds garble into a directory, returning the binary's path.
+func buildGarble(b *testing.B, dir string) string {
+	garbleBin := filepath.Join(dir, "garble")
+	if runtime.GOOS == "windows" {
+		garbleBin += ".exe"
+	}
+
+	if err := exec.Command("go", "build", "-o="+garbleBin).Run(); err != nil {
+		b.Fatalf("building garble: %v", err)
+	}
+	return garbleBin
+}
@@ -0,0 +1,1001 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// flattenDirective marks a function to be flattened even without -controlflow.
+const flattenDirective = "//garble:flatten"
+
+// flattenControlFlow rewrites the bodies of the functions in a file into a
+// loop which runs one block of the original code at a time, depending on a
+// state variable. This is done for all functions with -controlflow, and only
+// for those marked with //garble:flatten otherwise.
+//
+// Functions which can't be flattened safely are left as-is; see flattener.
+func (tf *transformer) flattenControlFlow(file *ast.File, name string) {
+	if strings.HasPrefix(name, "_cgo_") {
+		return
+	}
+	rand := newRand("controlflow", name)
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		flatten, directives := opts.ControlFlow, false
+		if fn.Doc != nil {
+			for _, comment := range fn.Doc.List {
+				switch {
+				case comment.Text == flattenDirective:
+					flatten = true
+				case strings.HasPrefix(comment.Text, "//go:"):
+					directives = true
+				}
+			}
+		}
+		// Directives like go:nosplit can't afford the extra stack, so
+		// leave all of them alone.
+		if !flatten || directives {
+			continue
+		}
+		f := &flattener{tf: tf, rand: rand, file: file, fn: fn}
+		if body := f.flatten(); body != nil {
+			fn.Body = body
+		}
+	}
+}
+
+// flattener flattens the body of a single function.
+//
+// Plain statements, blocks, ifs and for loops with a condition are split
+// into states; the others, such as switch, select and range statements, are
+// kept whole within a state. Since the states share a scope, the variables
+// and constants declared in the split statements are declared at the top of
+// the function instead, renamed if they could clash.
+//
+// A variable declared within a loop is a new variable in each iteration, so a
+// loop is only split when none of its variables can outlive an iteration, such
+// as via a closure or a pointer. The same applies to any variable when the
+// function uses goto. Functions which declare types, or whose variables have
+// types we can't spell out, aren't flattened at all.
+type flattener struct {
+	tf   *transformer
+	rand *mathrand.Rand
+	file *ast.File
+	fn   *ast.FuncDecl
+
+	// names holds the objects of the identifiers used in the function, by
+	// name, to tell if a hoisted name could clash.
+	names    map[string]map[types.Object]bool
+	params   map[string]bool
+	reserved map[string]bool
+	escaping map[*types.Var]bool
+	hasGoto  bool
+	failed   bool
+
+	state      string // name of the state variable
+	label      string // label of the dispatcher loop
+	labelUsed  bool
+	usedStates map[int]bool
+
+	cases []*ast.CaseClause
+	cur   *ast.CaseClause // nil if the last state was left
+
+	labelStates map[string]int
+	targets     map[string]*branchTarget // by label
+	loops       []*branchTarget          // enclosing split loops
+	repeat      bool                     // within a split loop
+
+	hoisted  []types.Object // variables and constants, in order
+	consts   []ast.Stmt
+	vars     []ast.Spec
+	branches map[*ast.BranchStmt]int // within kept statements
+}
+
+// branchTarget holds the states which break and continue jump to in a loop.
+type branchTarget struct {
+	brk, cont int
+}
+
+// flatten returns the flattened function body, or nil if the function can't
+// be flattened.
+func (f *flattener) flatten() *ast.BlockStmt {
+	if !f.analyze() {
+		return nil
+	}
+	f.state = f.freshName("state")
+	f.label = f.freshName("dispatch")
+	f.reserved[f.state] = true
+	f.usedStates = make(map[int]bool)
+	f.labelStates = make(map[string]int)
+	f.targets = make(map[string]*branchTarget)
+	f.branches = make(map[*ast.BranchStmt]int)
+
+	first := f.newState()
+	f.open(first)
+	f.lowerList(f.fn.Body.List)
+	if f.cur != nil && f.fn.Type.Results.NumFields() == 0 {
+		f.emit(&ast.ReturnStmt{})
+	}
+	if f.failed {
+		return nil
+	}
+	return f.commit(first)
+}
+
+// analyze records what we need to know about the function before splitting
+// it, and reports whether it can be flattened at all.
+func (f *flattener) analyze() bool {
+	info := f.tf.info
+	f.names = make(map[string]map[types.Object]bool)
+	f.params = make(map[string]bool)
+	f.reserved = make(map[string]bool)
+	ok := true
+	ast.Inspect(f.fn, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Ident:
+			objs := f.names[node.Name]
+			if objs == nil {
+				objs = make(map[types.Object]bool)
+				f.names[node.Name] = objs
+			}
+			if obj := info.ObjectOf(node); obj != nil {
+				objs[obj] = true
+			}
+		case *ast.GenDecl:
+			if node.Tok == token.TYPE {
+				ok = false
+			}
+		case *ast.BranchStmt:
+			if node.Tok == token.GOTO {
+				f.hasGoto = true
+			}
+		}
+		return ok
+	})
+	for _, list := range []*ast.FieldList{f.fn.Recv, f.fn.Type.Params, f.fn.Type.Results} {
+		if list == nil {
+			continue
+		}
+		for _, field := range list.List {
+			for _, name := range field.Names {
+				f.params[name.Name] = true
+			}
+		}
+	}
+	f.escaping = escapingVars(f.tf.info, f.fn.Body)
+	return ok
+}
+
+// escapingVars returns the variables which might be used beyond a single run
+// of their declaration and the code which follows it, such as via a closure or
+// a pointer.
+func escapingVars(info *types.Info, body *ast.BlockStmt) map[*types.Var]bool {
+	escaping := make(map[*types.Var]bool)
+	markRoot := func(expr ast.Expr) {
+		if v := rootVar(info, expr); v != nil {
+			escaping[v] = true
+		}
+	}
+	var funcs []*ast.FuncLit
+	var stack []ast.Node
+	ast.Inspect(body, func(node ast.Node) bool {
+		if node == nil {
+			if _, ok := stack[len(stack)-1].(*ast.FuncLit); ok {
+				funcs = funcs[:len(funcs)-1]
+			}
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, node)
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			funcs = append(funcs, node)
+		case *ast.Ident:
+			v, ok := info.Uses[node].(*types.Var)
+			if ok && len(funcs) > 0 {
+				lit := funcs[len(funcs)-1]
+				if v.Pos() < lit.Pos() || v.Pos() >= lit.End() {
+					escaping[v] = true // captured by a closure
+				}
+			}
+		case *ast.UnaryExpr:
+			if node.Op == token.AND {
+				markRoot(node.X)
+			}
+		case *ast.SelectorExpr:
+			// Calling a pointer method on a variable takes its address.
+			fn, ok := info.Uses[node.Sel].(*types.Func)
+			if !ok {
+				break
+			}
+			recv := fn.Type().(*types.Signature).Recv()
+			if recv == nil {
+				break
+			}
+			if _, ok := recv.Type().(*types.Pointer); !ok {
+				break
+			}
+			if _, ok := info.TypeOf(node.X).(*types.Pointer); !ok {
+				markRoot(node.X)
+			}
+		case *ast.SliceExpr:
+			if _, ok := info.TypeOf(node.X).Underlying().(*types.Array); ok {
+				markRoot(node.X)
+			}
+		}
+		return true
+	})
+	return escaping
+}
+
+// rootVar returns the variable which holds the value of an addressable
+// expression, such as v in v.field[2], or nil if there isn't one.
+func rootVar(info *types.Info, expr ast.Expr) *types.Var {
+	for {
+		switch x := expr.(type) {
+		case *ast.ParenExpr:
+			expr = x.X
+		case *ast.SelectorExpr:
+			field, ok := info.Uses[x.Sel].(*types.Var)
+			if !ok || !field.IsField() {
+				return nil
+			}
+			if _, ok := info.TypeOf(x.X).Underlying().(*types.Pointer); ok {
+				return nil
+			}
+			expr = x.X
+		case *ast.IndexExpr:
+			if _, ok := info.TypeOf(x.X).Underlying().(*types.Array); !ok {
+				return nil
+			}
+			expr = x.X
+		case *ast.Ident:
+			v, _ := info.Uses[x].(*types.Var)
+			return v
+		default:
+			return nil
+		}
+	}
+}
+
+// canSplit reports whether a loop can be split into states, since none of the
+// variables declared within it escape.
+func (f *flattener) canSplit(loop *ast.ForStmt) bool {
+	split := true
+	ast.Inspect(loop, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if v, ok := f.tf.info.Defs[ident].(*types.Var); ok && f.escaping[v] {
+				split = false
+			}
+		}
+		return split
+	})
+	return split
+}
+
+func (f *flattener) newState() int {
+	for {
+		state := int(f.rand.Int31())
+		if !f.usedStates[state] {
+			f.usedStates[state] = true
+			return state
+		}
+	}
+}
+
+func (f *flattener) labelState(label string) int {
+	state, ok := f.labelStates[label]
+	if !ok {
+		state = f.newState()
+		f.labelStates[label] = state
+	}
+	return state
+}
+
+func (f *flattener) setState(state int) ast.Stmt {
+	return &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent(f.state)},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{ah.IntLit(state)},
+	}
+}
+
+// leave moves on to a state at the end of the current one, if reachable.
+func (f *flattener) leave(state int) {
+	if f.cur != nil {
+		f.cur.Body = append(f.cur.Body, f.setState(state))
+		f.cur = nil
+	}
+}
+
+// open starts a new state, which the current one moves on to.
+func (f *flattener) open(state int) {
+	f.leave(state)
+	f.cur = &ast.CaseClause{List: []ast.Expr{ah.IntLit(state)}}
+	f.cases = append(f.cases, f.cur)
+}
+
+func (f *flattener) emit(stmt ast.Stmt) {
+	if f.cur == nil {
+		f.open(f.newState()) // unreachable, but it must still compile
+	}
+	f.cur.Body = append(f.cur.Body, stmt)
+}
+
+// maybeSplit sometimes starts a new state between two plain statements, so
+// that runs of them don't stay together.
+func (f *flattener) maybeSplit() {
+	if f.cur != nil && len(f.cur.Body) > 0 && f.rand.Intn(2) == 0 {
+		f.open(f.newState())
+	}
+}
+
+func (f *flattener) jump(state int) {
+	f.emit(f.setState(state))
+	f.cur = nil
+}
+
+func (f *flattener) lowerList(list []ast.Stmt) {
+	for _, stmt := range list {
+		if f.failed {
+			return
+		}
+		f.lower(stmt)
+	}
+}
+
+func (f *flattener) lower(stmt ast.Stmt) {
+	info := f.tf.info
+	switch stmt := stmt.(type) {
+	case *ast.LabeledStmt:
+		f.open(f.labelState(stmt.Label.Name))
+		switch inner := stmt.Stmt.(type) {
+		case *ast.ForStmt:
+			if f.canSplit(inner) {
+				f.lowerFor(inner, stmt.Label.Name)
+			} else {
+				f.keep(stmt)
+			}
+		case *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			f.keep(stmt)
+		default:
+			f.lower(inner)
+		}
+	case *ast.ExprStmt, *ast.SendStmt, *ast.IncDecStmt, *ast.GoStmt, *ast.DeferStmt, *ast.EmptyStmt:
+		f.maybeSplit()
+		f.emit(stmt)
+	case *ast.AssignStmt:
+		f.maybeSplit()
+		if stmt.Tok != token.DEFINE {
+			f.emit(stmt)
+			break
+		}
+		for _, expr := range stmt.Lhs {
+			if v, ok := info.Defs[expr.(*ast.Ident)].(*types.Var); ok && v.Name() != "_" {
+				f.hoistVar(v, nil)
+			}
+		}
+		f.emit(&ast.AssignStmt{Lhs: stmt.Lhs, TokPos: stmt.TokPos, Tok: token.ASSIGN, Rhs: stmt.Rhs})
+	case *ast.DeclStmt:
+		f.lowerDecl(stmt)
+	case *ast.ReturnStmt:
+		f.emit(stmt)
+		f.cur = nil
+	case *ast.BranchStmt:
+		switch stmt.Tok {
+		case token.GOTO:
+			f.jump(f.labelState(stmt.Label.Name))
+		case token.BREAK, token.CONTINUE:
+			target := f.target(stmt)
+			if target == nil {
+				f.failed = true
+			} else if stmt.Tok == token.BREAK {
+				f.jump(target.brk)
+			} else {
+				f.jump(target.cont)
+			}
+		default:
+			f.failed = true // fallthrough is only valid in switches
+		}
+	case *ast.BlockStmt:
+		f.lowerList(stmt.List)
+	case *ast.IfStmt:
+		f.lowerIf(stmt)
+	case *ast.ForStmt:
+		if f.canSplit(stmt) {
+			f.lowerFor(stmt, "")
+		} else {
+			f.keep(stmt)
+		}
+	case *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		f.keep(stmt)
+	default:
+		f.failed = true
+	}
+}
+
+func (f *flattener) target(stmt *ast.BranchStmt) *branchTarget {
+	if stmt.Label != nil {
+		return f.targets[stmt.Label.Name]
+	}
+	if len(f.loops) == 0 {
+		return nil
+	}
+	return f.loops[len(f.loops)-1]
+}
+
+func (f *flattener) lowerDecl(stmt *ast.DeclStmt) {
+	info := f.tf.info
+	decl := stmt.Decl.(*ast.GenDecl)
+	if decl.Tok == token.CONST {
+		// Constants can be declared at the top as they are, as long as
+		// they don't use any local variables, such as len(array).
+		ast.Inspect(decl, func(node ast.Node) bool {
+			ident, ok := node.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			if obj := info.Defs[ident]; obj != nil && obj.Name() != "_" {
+				f.hoisted = append(f.hoisted, obj)
+			}
+			if v, ok := info.Uses[ident].(*types.Var); ok && v.Parent() != v.Pkg().Scope() {
+				f.failed = true
+			}
+			return true
+		})
+		f.consts = append(f.consts, stmt)
+		return
+	}
+	for _, spec := range decl.Specs {
+		spec := spec.(*ast.ValueSpec)
+		var names []*ast.Ident
+		for _, name := range spec.Names {
+			v, ok := info.Defs[name].(*types.Var)
+			if !ok || v.Name() == "_" {
+				continue
+			}
+			if spec.Type == nil {
+				f.hoistVar(v, nil)
+			} else {
+				names = append(names, f.hoistVar(v, spec.Type))
+			}
+		}
+		if len(names) > 0 {
+			f.vars = append(f.vars, &ast.ValueSpec{Names: names, Type: spec.Type})
+		}
+
+		if len(spec.Values) > 0 {
+			lhs := make([]ast.Expr, len(spec.Names))
+			for i, name := range spec.Names {
+				lhs[i] = name
+			}
+			f.emit(&ast.AssignStmt{Lhs: lhs, Tok: token.ASSIGN, Rhs: spec.Values})
+			continue
+		}
+		if !f.repeat && !f.hasGoto {
+			continue // the hoisted variable is still zero
+		}
+		for _, name := range spec.Names {
+			if name.Name == "_" {
+				continue
+			}
+			zero := f.zeroValue(info.Defs[name].Type())
+			if zero == nil {
+				f.failed = true
+				return
+			}
+			f.emit(&ast.AssignStmt{Lhs: []ast.Expr{name}, Tok: token.ASSIGN, Rhs: []ast.Expr{zero}})
+		}
+	}
+}
+
+// hoistVar declares a variable at the top of the function. If typ is nil, the
+// declaration is added here, and its type is spelled out from the type
+// information. Otherwise, the caller adds the returned name to a declaration
+// with that type.
+func (f *flattener) hoistVar(v *types.Var, typ ast.Expr) *ast.Ident {
+	if f.hasGoto && f.escaping[v] {
+		// The declaration might be run more than once.
+		f.failed = true
+	}
+	f.hoisted = append(f.hoisted, v)
+	name := ast.NewIdent(v.Name())
+	f.tf.info.Defs[name] = v
+	if typ == nil {
+		typ = f.typeExpr(v.Type())
+		if typ == nil {
+			f.failed = true
+			return name
+		}
+		f.vars = append(f.vars, &ast.ValueSpec{Names: []*ast.Ident{name}, Type: typ})
+	}
+	return name
+}
+
+func (f *flattener) lowerIf(stmt *ast.IfStmt) {
+	if stmt.Init != nil {
+		f.lower(stmt.Init)
+	}
+	then, after := f.newState(), f.newState()
+	els := after
+	if stmt.Else != nil {
+		els = f.newState()
+	}
+	f.emit(&ast.IfStmt{
+		If:   stmt.If,
+		Cond: stmt.Cond,
+		Body: ah.BlockStmt(f.setState(then)),
+		Else: ah.BlockStmt(f.setState(els)),
+	})
+	f.cur = nil
+
+	f.open(then)
+	f.lowerList(stmt.Body.List)
+	f.leave(after)
+	if stmt.Else != nil {
+		f.open(els)
+		f.lower(stmt.Else)
+		f.leave(after)
+	}
+	f.open(after)
+}
+
+func (f *flattener) lowerFor(stmt *ast.ForStmt, label string) {
+	if stmt.Init != nil {
+		f.lower(stmt.Init)
+	}
+	cond, body, post, after := f.newState(), f.newState(), f.newState(), f.newState()
+	f.open(cond)
+	if stmt.Cond != nil {
+		f.emit(&ast.IfStmt{
+			If:   stmt.For,
+			Cond: stmt.Cond,
+			Body: ah.BlockStmt(f.setState(body)),
+			Else: ah.BlockStmt(f.setState(after)),
+		})
+		f.cur = nil
+	}
+
+	target := &branchTarget{brk: after, cont: post}
+	if label != "" {
+		f.targets[label] = target
+	}
+	f.loops = append(f.loops, target)
+	repeat := f.repeat
+	f.repeat = true
+
+	f.open(body)
+	f.lowerList(stmt.Body.List)
+
+	f.loops = f.loops[:len(f.loops)-1]
+	f.repeat = repeat
+
+	f.open(post)
+	if stmt.Post != nil {
+		f.lower(stmt.Post)
+	}
+	f.leave(cond)
+	f.open(after)
+}
+
+// keep adds a statement to the current state as a whole. Its break, continue
+// and goto statements which jump out of it are replaced by state changes.
+func (f *flattener) keep(stmt ast.Stmt) {
+	// Labels declared within the statement can only be jumped to from
+	// within it, so those jumps stay the same.
+	inner := make(map[string]bool)
+	ast.Inspect(stmt, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.LabeledStmt:
+			if node != stmt {
+				inner[node.Label.Name] = true
+			}
+		}
+		return true
+	})
+
+	var stack []ast.Node
+	ast.Inspect(stmt, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false // closures have their own branches
+		case *ast.BranchStmt:
+			f.keepBranch(node, stack, inner)
+		}
+		stack = append(stack, node)
+		return true
+	})
+	f.emit(stmt)
+}
+
+func (f *flattener) keepBranch(stmt *ast.BranchStmt, stack []ast.Node, inner map[string]bool) {
+	if stmt.Label != nil {
+		switch stmt.Tok {
+		case token.GOTO:
+			if !inner[stmt.Label.Name] {
+				f.branches[stmt] = f.labelState(stmt.Label.Name)
+			}
+		case token.BREAK, token.CONTINUE:
+			if target := f.targets[stmt.Label.Name]; target != nil {
+				f.branches[stmt] = target.brk
+				if stmt.Tok == token.CONTINUE {
+					f.branches[stmt] = target.cont
+				}
+			}
+		}
+		return
+	}
+	if stmt.Tok != token.BREAK && stmt.Tok != token.CONTINUE {
+		return
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		switch stack[i].(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			return
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			if stmt.Tok == token.BREAK {
+				return
+			}
+		}
+	}
+	// The statement jumps out of the kept one, to a split loop.
+	target := f.target(stmt)
+	if target == nil {
+		f.failed = true
+		return
+	}
+	f.branches[stmt] = target.brk
+	if stmt.Tok == token.CONTINUE {
+		f.branches[stmt] = target.cont
+	}
+}
+
+// commit renames the hoisted names, replaces the branches out of kept
+// statements, and returns the flattened body.
+func (f *flattener) commit(first int) *ast.BlockStmt {
+	info := f.tf.info
+	renamed := make(map[types.Object]string)
+	for _, obj := range f.hoisted {
+		name := obj.Name()
+		if len(f.names[name]) > 1 || f.reserved[name] || f.isGlobal(name) {
+			name = f.freshName(name)
+			renamed[obj] = name
+		}
+		f.reserved[name] = true
+	}
+
+	caseStmts := make([]ast.Stmt, len(f.cases))
+	for i, clause := range f.cases {
+		caseStmts[i] = clause
+	}
+	f.rand.Shuffle(len(caseStmts), func(i, j int) {
+		caseStmts[i], caseStmts[j] = caseStmts[j], caseStmts[i]
+	})
+	var loop ast.Stmt = &ast.ForStmt{Body: ah.BlockStmt(&ast.SwitchStmt{
+		Tag:  ast.NewIdent(f.state),
+		Body: ah.BlockStmt(caseStmts...),
+	})}
+
+	body := ah.BlockStmt(f.consts...)
+	if len(f.vars) > 0 {
+		body.List = append(body.List, &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: f.vars}})
+	}
+	body.List = append(body.List,
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent(f.state)},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{ah.IntLit(first)},
+		},
+		loop,
+	)
+
+	body = astutil.Apply(body, func(cursor *astutil.Cursor) bool {
+		switch node := cursor.Node().(type) {
+		case *ast.Ident:
+			if name, ok := renamed[info.ObjectOf(node)]; ok {
+				node.Name = name
+			}
+		case *ast.BranchStmt:
+			if state, ok := f.branches[node]; ok {
+				f.labelUsed = true
+				cursor.Replace(ah.BlockStmt(f.setState(state), &ast.BranchStmt{
+					Tok:   token.CONTINUE,
+					Label: ast.NewIdent(f.label),
+				}))
+			}
+		}
+		return true
+	}, nil).(*ast.BlockStmt)
+
+	// Labels on kept statements are only needed if their break or continue
+	// statements are still there.
+	usedLabels := make(map[string]bool)
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BranchStmt:
+			if node.Label != nil {
+				usedLabels[node.Label.Name] = true
+			}
+		}
+		return true
+	})
+	for _, clause := range f.cases {
+		for i, stmt := range clause.Body {
+			if labeled, ok := stmt.(*ast.LabeledStmt); ok && !usedLabels[labeled.Label.Name] {
+				clause.Body[i] = labeled.Stmt
+			}
+		}
+	}
+	if f.labelUsed {
+		body.List[len(body.List)-1] = &ast.LabeledStmt{Label: ast.NewIdent(f.label), Stmt: loop}
+	}
+	return body
+}
+
+// isGlobal reports whether a name is declared outside of the function, which a
+// hoisted declaration could shadow.
+func (f *flattener) isGlobal(name string) bool {
+	if f.tf.pkg.Scope().Lookup(name) != nil || types.Universe.Lookup(name) != nil {
+		return true
+	}
+	for _, imp := range f.file.Imports {
+		if imp.Name != nil && imp.Name.Name == name {
+			return true
+		}
+		path, _ := strconv.Unquote(imp.Path.Value)
+		if imp.Name == nil && f.importedName(path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *flattener) freshName(base string) string {
+	name := base
+	for i := 2; f.names[name] != nil || f.reserved[name] || f.isGlobal(name); i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	return name
+}
+
+// importedName returns the name of a package imported by the current package.
+func (f *flattener) importedName(path string) string {
+	for _, pkg := range f.tf.pkg.Imports() {
+		if pkg.Path() == path {
+			return pkg.Name()
+		}
+	}
+	return ""
+}
+
+// refer returns an identifier which refers to a package-level object at the
+// top of the function, or nil if it's shadowed there.
+func (f *flattener) refer(name string, obj types.Object) ast.Expr {
+	if f.params[name] {
+		return nil
+	}
+	f.reserved[name] = true
+	ident := ast.NewIdent(name)
+	if obj != nil {
+		f.tf.info.Uses[ident] = obj
+	}
+	return ident
+}
+
+// qualified returns an expression referring to an exported name in another
+// package, or nil if the current file can't refer to it.
+func (f *flattener) qualified(obj types.Object) ast.Expr {
+	if !obj.Exported() {
+		return nil
+	}
+	for _, imp := range f.file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		if path != obj.Pkg().Path() {
+			continue
+		}
+		pkgName := f.importedName(path)
+		if imp.Name != nil {
+			pkgName = imp.Name.Name
+		}
+		switch pkgName {
+		case "", "_":
+			continue
+		case ".":
+			return f.refer(obj.Name(), obj)
+		}
+		x := f.refer(pkgName, nil)
+		if x == nil {
+			return nil
+		}
+		sel := ast.NewIdent(obj.Name())
+		f.tf.info.Uses[sel] = obj
+		return &ast.SelectorExpr{X: x, Sel: sel}
+	}
+	return nil
+}
+
+// typeExpr spells out a type, or returns nil if it can't be done at the top of
+// the function.
+func (f *flattener) typeExpr(typ types.Type) ast.Expr {
+	switch typ := typ.(type) {
+	case *types.Basic:
+		if typ.Kind() == types.UnsafePointer {
+			return f.qualified(types.Unsafe.Scope().Lookup("Pointer"))
+		}
+		if typ.Info()&types.IsUntyped != 0 {
+			return nil
+		}
+		return f.universe(typ.Name())
+	case *types.Named:
+		obj := typ.Obj()
+		switch {
+		case obj.Pkg() == nil:
+			return f.universe(obj.Name()) // error
+		case obj.Parent() != obj.Pkg().Scope():
+			return nil // declared in a function
+		case obj.Type() != typ:
+			return nil // not the declared type, e.g. with type arguments
+		case obj.Pkg() == f.tf.pkg:
+			return f.refer(obj.Name(), obj)
+		}
+		return f.qualified(obj)
+	case *types.Pointer:
+		if elem := f.typeExpr(typ.Elem()); elem != nil {
+			return &ast.StarExpr{X: elem}
+		}
+	case *types.Slice:
+		if elem := f.typeExpr(typ.Elem()); elem != nil {
+			return &ast.ArrayType{Elt: elem}
+		}
+	case *types.Array:
+		if elem := f.typeExpr(typ.Elem()); elem != nil {
+			return &ast.ArrayType{Len: ah.IntLit(int(typ.Len())), Elt: elem}
+		}
+	case *types.Map:
+		key, value := f.typeExpr(typ.Key()), f.typeExpr(typ.Elem())
+		if key != nil && value != nil {
+			return &ast.MapType{Key: key, Value: value}
+		}
+	case *types.Chan:
+		elem := f.typeExpr(typ.Elem())
+		if elem == nil {
+			return nil
+		}
+		dir := ast.SEND | ast.RECV
+		switch typ.Dir() {
+		case types.SendOnly:
+			dir = ast.SEND
+		case types.RecvOnly:
+			dir = ast.RECV
+		}
+		if inner, ok := typ.Elem().(*types.Chan); ok && inner.Dir() == types.RecvOnly {
+			elem = &ast.ParenExpr{X: elem} // not to be read as chan<-
+		}
+		return &ast.ChanType{Dir: dir, Value: elem}
+	case *types.Signature:
+		params := f.tupleFields(typ.Params(), typ.Variadic())
+		results := f.tupleFields(typ.Results(), false)
+		if params != nil && results != nil {
+			return &ast.FuncType{Params: params, Results: results}
+		}
+	case *types.Struct:
+		fields := &ast.FieldList{}
+		for i := 0; i < typ.NumFields(); i++ {
+			v := typ.Field(i)
+			if !v.Exported() && v.Pkg() != f.tf.pkg {
+				return nil
+			}
+			fieldType := f.typeExpr(v.Type())
+			if fieldType == nil {
+				return nil
+			}
+			field := &ast.Field{Type: fieldType}
+			if !v.Embedded() {
+				name := ast.NewIdent(v.Name())
+				f.tf.info.Defs[name] = v
+				field.Names = []*ast.Ident{name}
+			}
+			if tag := typ.Tag(i); tag != "" {
+				field.Tag = &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(tag)}
+			}
+			fields.List = append(fields.List, field)
+		}
+		return &ast.StructType{Fields: fields}
+	case *types.Interface:
+		methods := &ast.FieldList{}
+		for i := 0; i < typ.NumMethods(); i++ {
+			method := typ.Method(i)
+			if !method.Exported() && method.Pkg() != f.tf.pkg {
+				return nil
+			}
+			sig := method.Type().(*types.Signature)
+			params := f.tupleFields(sig.Params(), sig.Variadic())
+			results := f.tupleFields(sig.Results(), false)
+			if params == nil || results == nil {
+				return nil
+			}
+			name := ast.NewIdent(method.Name())
+			f.tf.info.Defs[name] = method
+			methods.List = append(methods.List, &ast.Field{
+				Names: []*ast.Ident{name},
+				Type:  &ast.FuncType{Params: params, Results: results},
+			})
+		}
+		return &ast.InterfaceType{Methods: methods}
+	}
+	return nil
+}
+
+func (f *flattener) tupleFields(tuple *types.Tuple, variadic bool) *ast.FieldList {
+	fields := &ast.FieldList{}
+	for i := 0; i < tuple.Len(); i++ {
+		typ := tuple.At(i).Type()
+		if variadic && i == tuple.Len()-1 {
+			elem := f.typeExpr(typ.(*types.Slice).Elem())
+			if elem == nil {
+				return nil
+			}
+			fields.List = append(fields.List, &ast.Field{Type: &ast.Ellipsis{Elt: elem}})
+			continue
+		}
+		expr := f.typeExpr(typ)
+		if expr == nil {
+			return nil
+		}
+		fields.List = append(fields.List, &ast.Field{Type: expr})
+	}
+	return fields
+}
+
+// universe refers to a name in the universe scope, such as int or nil.
+func (f *flattener) universe(name string) ast.Expr {
+	if f.tf.pkg.Scope().Lookup(name) != nil {
+		return nil
+	}
+	return f.refer(name, nil)
+}
+
+// zeroValue returns an expression for the zero value of a type, or nil if it
+// can't be spelled out.
+func (f *flattener) zeroValue(typ types.Type) ast.Expr {
+	switch under := typ.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case under.Info()&types.IsBoolean != 0:
+			return f.universe("false")
+		case under.Info()&types.IsString != 0:
+			return &ast.BasicLit{Kind: token.STRING, Value: `""`}
+		case under.Info()&types.IsNumeric != 0:
+			return ah.IntLit(0)
+		}
+	case *types.Struct, *types.Array:
+		if expr := f.typeExpr(typ); expr != nil {
+			return &ast.CompositeLit{Type: expr}
+		}
+		return nil
+	}
+	return f.universe("nil")
+}
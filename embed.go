@@ -0,0 +1,574 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+	"mvdan.cc/garble/internal/literals"
+)
+
+// embedConfig is the file which cmd/go passes to the compiler via -embedcfg
+// since Go 1.16. It maps each //go:embed pattern to the names of the files it
+// matches, and each of those names to the file's path on disk.
+type embedConfig struct {
+	Patterns map[string][]string
+	Files    map[string]string
+}
+
+// embedMagic prefixes the contents of the embed.FS files which we encrypted,
+// so that the patched embed package knows which files to decrypt. It is
+// followed by the file's 12-byte ChaCha20 nonce, and then by its encrypted
+// contents. The key is not part of the file; see embedKey.
+const embedMagic = "\x8e\x1f\xc4\x5d\x07\xb2\x69\xea"
+
+// embedNonceSize is the size of the nonce which follows embedMagic.
+const embedNonceSize = 12
+
+// embedKey returns the ChaCha20 key which the embedded files are encrypted
+// with. The patched embed package has it built in, so it must be the same for
+// the whole build; it is derived from garble's own build ID and the seed, which
+// are part of the action ID of every package.
+func embedKey() ([]byte, error) {
+	buildID, err := buildidOf(cache.ExecPath)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	io.WriteString(h, "embed key ")
+	h.Write(decodeHash(splitContentID(buildID)))
+	h.Write(opts.Seed)
+	return h.Sum(nil), nil
+}
+
+// encryptEmbedFile encrypts the contents of a file in an embed.FS with the
+// given key, in the format described by embedMagic.
+func encryptEmbedFile(rand *mathrand.Rand, key, data []byte) []byte {
+	out := make([]byte, len(embedMagic)+embedNonceSize+len(data))
+	copy(out, embedMagic)
+	nonce := out[len(embedMagic) : len(embedMagic)+embedNonceSize]
+	rand.Read(nonce)
+	encrypted := out[len(embedMagic)+embedNonceSize:]
+	copy(encrypted, data)
+	literals.ChaChaXOR(append(key[:len(key):len(key)], nonce...), encrypted)
+	return out
+}
+
+// embedDirective finds the //go:embed directives in a comment group, and
+// returns the patterns they list, while removing them from the group if
+// remove is true.
+func embedDirective(group *ast.CommentGroup, remove bool) (patterns []string, err error) {
+	if group == nil {
+		return nil, nil
+	}
+	var kept []*ast.Comment
+	for _, comment := range group.List {
+		args := strings.TrimPrefix(comment.Text, "//go:embed")
+		if args == comment.Text || (args != "" && args[0] != ' ' && args[0] != '\t') {
+			kept = append(kept, comment)
+			continue
+		}
+		list, err := parseEmbedPatterns(args)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, list...)
+	}
+	if remove {
+		group.List = kept
+	}
+	return patterns, nil
+}
+
+// parseEmbedPatterns splits the arguments to a //go:embed directive, which
+// may be quoted with double quotes or backquotes to contain spaces.
+func parseEmbedPatterns(args string) ([]string, error) {
+	var patterns []string
+	for {
+		args = strings.TrimLeft(args, " \t")
+		if args == "" {
+			return patterns, nil
+		}
+		end := strings.IndexAny(args, " \t")
+		switch args[0] {
+		case '"':
+			end = 1
+			for end < len(args) && args[end] != '"' {
+				if args[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+		case '`':
+			end = strings.IndexByte(args[1:], '`') + 2
+		}
+		if end < 0 || end > len(args) {
+			end = len(args)
+		}
+		pattern := args[:end]
+		if pattern[0] == '"' || pattern[0] == '`' {
+			var err error
+			if pattern, err = strconv.Unquote(pattern); err != nil {
+				return nil, fmt.Errorf("invalid quoted string in //go:embed: %s", args[:end])
+			}
+		}
+		patterns = append(patterns, pattern)
+		args = args[end:]
+	}
+}
+
+// embedVar is a variable declared with //go:embed.
+type embedVar struct {
+	file     *ast.File
+	spec     *ast.ValueSpec
+	group    *ast.CommentGroup // holding the directive
+	obj      types.Object
+	patterns []string
+}
+
+// embedVars returns the variables in files which are declared with
+// //go:embed.
+func (tf *transformer) embedVars(files []*ast.File) ([]embedVar, error) {
+	var vars []embedVar
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				spec := spec.(*ast.ValueSpec)
+				group := spec.Doc
+				if group == nil && len(decl.Specs) == 1 {
+					group = decl.Doc
+				}
+				patterns, err := embedDirective(group, false)
+				if err != nil {
+					return nil, err
+				}
+				if len(patterns) == 0 || len(spec.Names) != 1 {
+					continue // the compiler will report any errors
+				}
+				obj := tf.info.Defs[spec.Names[0]]
+				if obj == nil {
+					continue
+				}
+				vars = append(vars, embedVar{
+					file:     file,
+					spec:     spec,
+					group:    group,
+					obj:      obj,
+					patterns: patterns,
+				})
+			}
+		}
+	}
+	return vars, nil
+}
+
+// transformEmbeds obfuscates the files embedded in the package via //go:embed,
+// given the path to its -embedcfg file. It returns the path to a new embed
+// configuration, or the empty string if the original one can still be used.
+//
+// String and byte slice variables are given an initial value with their
+// contents obfuscated like literals, and their directives are removed. The
+// files of embed.FS variables are encrypted instead, and decrypted by our
+// patched embed package; see embedPatch. The names of those files are hashed
+// too, unless a string literal in the package might refer to them, or their
+// variable is exported. The files of string and byte slice variables which are
+// too large for literals are encrypted the same way, and decrypted by their
+// variable's initial value; see embedDecrypt.
+func (tf *transformer) transformEmbeds(files []*ast.File, cfgPath string, level literals.Level, stats *literals.Stats) (string, error) {
+	data, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		return "", err
+	}
+	var cfg embedConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("cannot parse -embedcfg: %v", err)
+	}
+	vars, err := tf.embedVars(files)
+	if err != nil {
+		return "", err
+	}
+
+	// The string literals which might name embedded files. Note that
+	// tf.info still has the original literals, even after they have been
+	// obfuscated.
+	var literalNames []string
+	for _, tv := range tf.info.Types {
+		if tv.Value != nil && tv.Value.Kind() == constant.String {
+			literalNames = append(literalNames, constant.StringVal(tv.Value))
+		}
+	}
+	keepName := make(map[string]bool)
+	encrypted := make(map[string]bool)
+	var key []byte
+	loadKey := func() (err error) {
+		if key == nil {
+			key, err = embedKey()
+		}
+		return err
+	}
+
+	for _, v := range vars {
+		var asString bool
+		switch typ := v.obj.Type(); {
+		case isEmbedFS(typ):
+			for _, pattern := range v.patterns {
+				for _, name := range cfg.Patterns[pattern] {
+					if strings.HasSuffix(name, "/") {
+						continue // a directory
+					}
+					encrypted[name] = true
+					if v.obj.Exported() || namedByLiteral(name, literalNames) {
+						keepName[name] = true
+					}
+				}
+			}
+			continue
+		case types.Identical(typ.Underlying(), types.Typ[types.String]):
+			asString = true
+		case types.Identical(typ.Underlying(), types.NewSlice(types.Typ[types.Byte])):
+		default:
+			continue
+		}
+		names := cfg.Patterns[v.patterns[0]]
+		if len(v.patterns) != 1 || len(names) != 1 {
+			continue // the compiler will report the error
+		}
+		contents, err := ioutil.ReadFile(cfg.Files[names[0]])
+		if err != nil {
+			return "", err
+		}
+		rand := newRand("embed", names[0])
+		value := literals.ObfuscateData(rand, contents, asString, level, opts.LiteralMaxSize, stats)
+		if value == nil {
+			// Too large for a literal. Embed the encrypted file into
+			// a new string variable instead, which the original
+			// variable decrypts.
+			encrypted[names[0]] = true
+			if err := loadKey(); err != nil {
+				return "", err
+			}
+			hidden := ast.NewIdent(hashWith(curActionID, "embed "+v.obj.Name()))
+			v.file.Decls = append(v.file.Decls, &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names:  v.spec.Names,
+					Type:   v.spec.Type,
+					Values: []ast.Expr{embedDecrypt(rand, hidden, v.spec.Type, key, level)},
+				}},
+			})
+			// Keep the positions, so that the directive stays
+			// in place when printed.
+			hidden.NamePos = v.spec.Names[0].Pos()
+			v.spec.Names = []*ast.Ident{hidden}
+			v.spec.Type = &ast.Ident{NamePos: v.spec.Type.Pos(), Name: "string"}
+			continue
+		}
+		if _, ok := v.obj.Type().(*types.Named); ok {
+			value = &ast.CallExpr{Fun: v.spec.Type, Args: []ast.Expr{value}}
+		}
+		v.spec.Values = []ast.Expr{value}
+		if _, err := embedDirective(v.group, true); err != nil {
+			return "", err
+		}
+	}
+	if len(encrypted) == 0 {
+		return "", nil
+	}
+	if err := loadKey(); err != nil {
+		return "", err
+	}
+
+	// Give each hashed name a file extension, so that patterns like
+	// "*.html" keep working. Names must also stay unique in their
+	// directory, so we keep the original name in the rare case of a
+	// collision.
+	// Sort the names, so that hash collisions are handled deterministically.
+	var names []string
+	taken := make(map[string]bool)
+	for name := range cfg.Files {
+		names = append(names, name)
+		taken[name] = true
+	}
+	sort.Strings(names)
+	renamed := make(map[string]string)
+	for _, name := range names {
+		if !encrypted[name] || keepName[name] {
+			continue
+		}
+		dir, base := path.Split(name)
+		newName := dir + hashWith(curActionID, name) + path.Ext(base)
+		if taken[newName] {
+			continue
+		}
+		taken[newName] = true
+		renamed[name] = newName
+	}
+
+	newCfg := embedConfig{
+		Patterns: make(map[string][]string, len(cfg.Patterns)),
+		Files:    make(map[string]string, len(cfg.Files)),
+	}
+	for pattern, names := range cfg.Patterns {
+		newNames := make([]string, len(names))
+		for i, name := range names {
+			if newName, ok := renamed[name]; ok {
+				name = newName
+			}
+			newNames[i] = name
+		}
+		newCfg.Patterns[pattern] = newNames
+	}
+	for _, name := range names {
+		diskPath := cfg.Files[name]
+		if !encrypted[name] {
+			newCfg.Files[name] = diskPath
+			continue
+		}
+		contents, err := ioutil.ReadFile(diskPath)
+		if err != nil {
+			return "", err
+		}
+		tempFile, err := ioutil.TempFile(sharedTempDir, "embed.*")
+		if err != nil {
+			return "", err
+		}
+		_, err = tempFile.Write(encryptEmbedFile(newRand("embed", name), key, contents))
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+		if newName, ok := renamed[name]; ok {
+			name = newName
+		}
+		newCfg.Files[name] = tempFile.Name()
+	}
+	tempFile, err := ioutil.TempFile(sharedTempDir, "embedcfg.*.json")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+	if err := json.NewEncoder(tempFile).Encode(newCfg); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+// embedDecrypt returns an expression of type typ, a string or byte slice type,
+// which decrypts the contents of the variable named hidden, which are in the
+// format described by embedMagic. The key is obfuscated like a literal, so
+// that it isn't next to the contents. That is:
+//
+//	func() typ {
+//		key := append(obfuscatedKey, hidden[M:M+N]...)
+//		data := []byte(hidden[M+N:])
+//		// ChaCha20, as in literals.ChaChaDecrypt
+//		return typ(data)
+//	}()
+func embedDecrypt(rand *mathrand.Rand, hidden *ast.Ident, typ ast.Expr, key []byte, level literals.Level) ast.Expr {
+	assign := func(lhs string, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(lhs)}, Tok: token.DEFINE, Rhs: []ast.Expr{rhs}}
+	}
+	// The key is far below any size limit.
+	obfuscatedKey := literals.ObfuscateData(rand, key, false, level, literals.DefaultMaxSize, nil)
+	stmts := []ast.Stmt{
+		assign("key", &ast.CallExpr{
+			Fun: ast.NewIdent("append"),
+			Args: []ast.Expr{obfuscatedKey, &ast.SliceExpr{
+				X:    hidden,
+				Low:  ah.IntLit(len(embedMagic)),
+				High: ah.IntLit(len(embedMagic) + embedNonceSize),
+			}},
+			Ellipsis: 1,
+		}),
+		assign("data", ah.CallExpr(&ast.ArrayType{Elt: ast.NewIdent("byte")},
+			&ast.SliceExpr{X: hidden, Low: ah.IntLit(len(embedMagic) + embedNonceSize)},
+		)),
+	}
+	stmts = append(stmts, literals.ChaChaDecrypt()...)
+	stmts = append(stmts, ah.ReturnStmt(ah.CallExpr(typ, ast.NewIdent("data"))))
+	return ah.LambdaCall(typ, ah.BlockStmt(stmts...))
+}
+
+// isEmbedFS reports whether typ is embed.FS.
+func isEmbedFS(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "embed" && obj.Name() == "FS"
+}
+
+// namedByLiteral reports whether any of the string literals might be used to
+// read the embedded file with the given name. That is the case if a literal is
+// the name itself, one of its parent directories, or a glob pattern matching
+// either of them.
+func namedByLiteral(name string, literalNames []string) bool {
+	for _, lit := range literalNames {
+		lit = strings.TrimSuffix(strings.TrimPrefix(lit, "./"), "/")
+		if lit == "" {
+			continue
+		}
+		for elem := name; elem != "."; elem = path.Dir(elem) {
+			if lit == elem {
+				return true
+			}
+			if ok, _ := path.Match(lit, elem); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// privateEmbeds reports whether any private package in the build embeds files,
+// in which case the embed package is patched to decrypt them.
+func privateEmbeds() bool {
+	for path, pkg := range cache.ListedPackages {
+		if !isPrivate(path) {
+			continue
+		}
+		if len(pkg.EmbedPatterns)+len(pkg.TestEmbedPatterns)+len(pkg.XTestEmbedPatterns) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// embedPatch is added to the embed package's source, so that the files
+// encrypted by transformEmbeds are decrypted whenever they are looked up. The
+// original lookup method is renamed by patchEmbed. Directory listings are left
+// as-is, as they only need the names of the files, which aren't encrypted; the
+// file sizes they report include the encryption overhead.
+//
+// The embed package can't import any new packages, so the ChaCha20 decryption
+// is printed from literals.ChaChaDecrypt.
+const embedPatch = `package embed
+
+func (f FS) lookup(name string) *file {
+	return decryptFile(f.lookupEncrypted(name))
+}
+
+func decryptFile(f *file) *file {
+	const magic = %q
+	const nonceSize = %d
+	if f == nil || len(f.data) < len(magic)+nonceSize || f.data[:len(magic)] != magic {
+		return f
+	}
+	key := append([]byte(%q), f.data[len(magic):len(magic)+nonceSize]...)
+	data := []byte(f.data[len(magic)+nonceSize:])
+%s
+	return &file{name: f.name, data: string(data), hash: f.hash}
+}
+`
+
+// patchEmbed renames the lookup method in the embed package's embed.go, which
+// is replaced by embedPatch. It returns the path to the patch, to be compiled
+// along with the package.
+//
+// Since the patch relies on unexported details of the embed package, an error
+// is returned if they aren't as expected, rather than miscompiling.
+func patchEmbed(file *ast.File) (string, error) {
+	found := map[string]bool{"lookup": false, "file": false}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil || len(decl.Recv.List) != 1 {
+				continue
+			}
+			if recv, ok := decl.Recv.List[0].Type.(*ast.Ident); !ok || recv.Name != "FS" {
+				continue
+			}
+			if decl.Name.Name == "lookup" {
+				found["lookup"] = true
+				decl.Name.Name = "lookupEncrypted"
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				if spec, ok := spec.(*ast.TypeSpec); ok && spec.Name.Name == "file" {
+					found["file"] = embedFileFields(spec.Type)
+				}
+			}
+		}
+	}
+	for _, name := range []string{"lookup", "file"} {
+		if !found[name] {
+			return "", fmt.Errorf("cannot decrypt embedded files: unsupported layout of %s in the embed package", name)
+		}
+	}
+	key, err := embedKey()
+	if err != nil {
+		return "", err
+	}
+	var decrypt bytes.Buffer
+	cfg := printer.Config{Mode: printer.TabIndent, Tabwidth: 8, Indent: 1}
+	for _, stmt := range literals.ChaChaDecrypt() {
+		if err := cfg.Fprint(&decrypt, token.NewFileSet(), stmt); err != nil {
+			return "", err
+		}
+		decrypt.WriteString("\n")
+	}
+	tempFile, err := ioutil.TempFile(sharedTempDir, "embed_patch.*.go")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+	if _, err := fmt.Fprintf(tempFile, embedPatch, embedMagic, embedNonceSize, key, decrypt.String()); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+// embedFileFields reports whether the embed package's file type is a struct
+// with the fields used by embedPatch: name and data strings, and a hash.
+func embedFileFields(typ ast.Expr) bool {
+	strct, ok := typ.(*ast.StructType)
+	if !ok {
+		return false
+	}
+	want := map[string]bool{"name": true, "data": true, "hash": true}
+	for _, field := range strct.Fields.List {
+		for _, name := range field.Names {
+			if !want[name.Name] {
+				continue
+			}
+			if name.Name != "hash" {
+				if ident, ok := field.Type.(*ast.Ident); !ok || ident.Name != "string" {
+					return false
+				}
+			}
+			delete(want, name.Name)
+		}
+	}
+	return len(want) == 0
+}
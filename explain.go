@@ -0,0 +1,185 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/Binject/debug/goobj2"
+)
+
+// explain records why obj was not obfuscated, if we are building for
+// "garble explain". The first reason for each object is kept.
+func (tf *transformer) explain(obj types.Object, reason string) {
+	if !opts.Explain {
+		return
+	}
+	if tf.explanations == nil {
+		tf.explanations = make(map[types.Object]string)
+	}
+	if _, ok := tf.explanations[obj]; !ok {
+		tf.explanations[obj] = reason
+	}
+}
+
+// explanationData encodes the reasons recorded in ignoreObjects and
+// explanations as sorted "name\treason" lines, to be stored in the object file
+// under headerExplain. That way, the explanations survive the build cache.
+func (tf *transformer) explanationData() []byte {
+	lines := make(map[string]bool)
+	add := func(m map[types.Object]string) {
+		for obj, reason := range m {
+			if obj == nil || obj.Pkg() == nil || !isPrivate(obj.Pkg().Path()) {
+				continue
+			}
+			if parent := obj.Parent(); parent != nil && parent != obj.Pkg().Scope() {
+				continue // local names never show up in the binary
+			}
+			lines[explainName(obj)+"\t"+reason+"\n"] = true
+		}
+	}
+	add(tf.ignoreObjects)
+	add(tf.explanations)
+
+	sorted := make([]string, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	sort.Strings(sorted)
+	return []byte(strings.Join(sorted, ""))
+}
+
+// explainName returns the qualified name of an object as used by
+// "garble explain", such as "pkg.Func", "pkg.Type.Method", or "pkg.Type.Field".
+func explainName(obj types.Object) string {
+	prefix := obj.Pkg().Path() + "."
+	switch obj := obj.(type) {
+	case *types.Func:
+		recv := obj.Type().(*types.Signature).Recv()
+		if recv == nil {
+			break
+		}
+		if named := namedType(recv.Type()); named != nil {
+			prefix += named.Obj().Name() + "."
+		}
+	case *types.Var:
+		if !obj.IsField() {
+			break
+		}
+		// Fields don't know what struct they belong to, so look for it.
+		scope := obj.Pkg().Scope()
+		for _, name := range scope.Names() {
+			strct, ok := scope.Lookup(name).Type().Underlying().(*types.Struct)
+			if !ok {
+				continue
+			}
+			for i := 0; i < strct.NumFields(); i++ {
+				if strct.Field(i) == obj {
+					return prefix + name + "." + obj.Name()
+				}
+			}
+		}
+	}
+	return prefix + obj.Name()
+}
+
+// commandExplain implements "garble explain".
+func commandExplain(args []string) error {
+	flags, args := splitFlagsFromArgs(args)
+	if len(args) < 1 {
+		return fmt.Errorf("usage: garble [flags] explain [build flags] pkg.Name [packages]")
+	}
+	query, patterns := args[0], args[1:]
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+
+	// Like "garble reverse", we use "go list -export" to get the object
+	// files for each package. With -explain, they also contain the
+	// reasons why each name wasn't obfuscated.
+	flagExplain = true
+	listArgs := []string{
+		"-json",
+		"-deps",
+		"-export",
+	}
+	listArgs = append(listArgs, flags...)
+	listArgs = append(listArgs, patterns...)
+	cmd, err := toolexecCmd("list", listArgs)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go list error: %v: %s", err, stderr.Bytes())
+	}
+
+	var pkgs []listedPackage
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var pkg listedPackage
+		if err := dec.Decode(&pkg); err != nil {
+			return err
+		}
+		if pkg.Export == "" {
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+		buildInfo.imports[pkg.ImportPath] = importedPkg{packagefile: pkg.Export}
+	}
+	importMap := func(importPath string) (objectPath string) {
+		return buildInfo.imports[importPath].packagefile
+	}
+
+	found := false
+	for _, pkg := range pkgs {
+		if !isPrivate(pkg.ImportPath) {
+			if strings.HasPrefix(query, pkg.ImportPath+".") {
+				fmt.Printf("%s: package %s is not private, see GOPRIVATE\n", query, pkg.ImportPath)
+				found = true
+			}
+			continue
+		}
+		objPkg, err := goobj2.Parse(pkg.Export, pkg.ImportPath, importMap)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		for _, member := range objPkg.ArchiveMembers {
+			if member.ArchiveHeader.Name == headerExplain {
+				data = member.ArchiveHeader.Data
+				break
+			}
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), "\t", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			name, reason := fields[0], fields[1]
+			if pkg.Name == "main" && strings.HasPrefix(name, "main.") {
+				// The main package is compiled as "main".
+				name = pkg.ImportPath + strings.TrimPrefix(name, "main")
+			}
+			if name != query && !strings.HasPrefix(name, query+".") {
+				continue
+			}
+			fmt.Printf("%s: %s (decided when building %s)\n", name, reason, pkg.ImportPath)
+			found = true
+		}
+	}
+	if !found {
+		fmt.Printf("%s: no reason recorded; it was obfuscated or not found\n", query)
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"go/ast"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// shuffleFields randomizes the order of the fields of unexported struct types
+// in a package, so that the layout in the binary doesn't mirror the source.
+// Unkeyed composite literals of those types are rewritten to be keyed.
+//
+// Only types whose layout can't be observed are shuffled; see fieldLayouts.
+func (tf *transformer) shuffleFields(files []*ast.File, paths []string) {
+	candidates := make(map[*types.Named]*ast.StructType)
+	for i, file := range files {
+		if strings.HasPrefix(filepath.Base(paths[i]), "_cgo_") {
+			continue
+		}
+		ast.Inspect(file, func(node ast.Node) bool {
+			spec, ok := node.(*ast.TypeSpec)
+			if !ok || spec.Assign.IsValid() || spec.Name.IsExported() || strings.HasPrefix(spec.Name.Name, "_C") {
+				return true
+			}
+			strct, ok := spec.Type.(*ast.StructType)
+			if !ok || len(strct.Fields.List) < 2 {
+				return true
+			}
+			obj, ok := tf.info.Defs[spec.Name].(*types.TypeName)
+			if !ok || tf.ignoreObjects[obj] != "" {
+				return true
+			}
+			// Blank fields are usually there for their layout, such as
+			// padding.
+			for _, field := range strct.Fields.List {
+				for _, name := range field.Names {
+					if name.Name == "_" {
+						return true
+					}
+				}
+			}
+			candidates[obj.Type().(*types.Named)] = strct
+			return true
+		})
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	l := &fieldLayouts{tf: tf, candidates: candidates, fixed: make(map[*types.Named]bool)}
+	l.analyze(files)
+
+	for i, file := range files {
+		rand := newRand("fields", filepath.Base(paths[i]))
+		ast.Inspect(file, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.TypeSpec:
+				obj, _ := tf.info.Defs[node.Name].(*types.TypeName)
+				if obj == nil {
+					break
+				}
+				named, _ := obj.Type().(*types.Named)
+				if strct := candidates[named]; strct != nil && !l.fixed[named] {
+					list := strct.Fields.List
+					rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+				}
+			case *ast.CompositeLit:
+				named, _ := tf.info.TypeOf(node).(*types.Named)
+				if candidates[named] == nil || l.fixed[named] {
+					break
+				}
+				if len(node.Elts) == 0 {
+					break
+				}
+				if _, ok := node.Elts[0].(*ast.KeyValueExpr); ok {
+					break
+				}
+				strct := named.Underlying().(*types.Struct)
+				for i, elt := range node.Elts {
+					key := ast.NewIdent(strct.Field(i).Name())
+					tf.info.Uses[key] = strct.Field(i)
+					node.Elts[i] = &ast.KeyValueExpr{Key: key, Value: elt}
+				}
+			}
+			return true
+		})
+	}
+}
+
+// fieldLayouts finds the struct types whose field order might be observed, and
+// must therefore be left alone. Types converted to interfaces might be
+// reflected on, such as when printed via fmt. Types used with package unsafe or
+// sync/atomic might depend on offsets, sizes, or alignment. Field order is part
+// of the identity of a struct type, so it matters for conversions between
+// struct types too. Finally, in packages other than main, other packages might
+// do any of the above with the types reachable from the exported API.
+//
+// A type containing another, such as via a field or a pointer, makes both
+// fixed.
+type fieldLayouts struct {
+	tf         *transformer
+	candidates map[*types.Named]*ast.StructType
+	fixed      map[*types.Named]bool
+
+	seen map[types.Type]bool
+}
+
+func (l *fieldLayouts) analyze(files []*ast.File) {
+	info := l.tf.info
+	for _, file := range files {
+		var sigs []*types.Signature
+		var stack []ast.Node
+		ast.Inspect(file, func(node ast.Node) bool {
+			if node == nil {
+				switch stack[len(stack)-1].(type) {
+				case *ast.FuncDecl, *ast.FuncLit:
+					sigs = sigs[:len(sigs)-1]
+				}
+				stack = stack[:len(stack)-1]
+				return true
+			}
+			stack = append(stack, node)
+			switch node := node.(type) {
+			case *ast.FuncDecl:
+				var sig *types.Signature
+				if obj := info.Defs[node.Name]; obj != nil {
+					sig, _ = obj.Type().(*types.Signature)
+				}
+				sigs = append(sigs, sig)
+			case *ast.FuncLit:
+				sig, _ := info.TypeOf(node).(*types.Signature)
+				sigs = append(sigs, sig)
+			case *ast.CallExpr:
+				l.call(node)
+			case *ast.AssignStmt:
+				if len(node.Lhs) == len(node.Rhs) {
+					for i, lhs := range node.Lhs {
+						l.assign(info.TypeOf(lhs), node.Rhs[i])
+					}
+				} else if len(node.Rhs) == 1 {
+					// v, err = load()
+					dsts := make([]types.Type, len(node.Lhs))
+					for i, lhs := range node.Lhs {
+						dsts[i] = info.TypeOf(lhs)
+					}
+					l.assignTuple(dsts, node.Rhs[0])
+				}
+			case *ast.ValueSpec:
+				if node.Type != nil {
+					typ := info.TypeOf(node.Type)
+					if len(node.Names) > 1 && len(node.Values) == 1 {
+						dsts := make([]types.Type, len(node.Names))
+						for i := range dsts {
+							dsts[i] = typ
+						}
+						l.assignTuple(dsts, node.Values[0])
+					}
+					for _, value := range node.Values {
+						l.assign(typ, value)
+					}
+				}
+			case *ast.ReturnStmt:
+				sig := sigs[len(sigs)-1]
+				switch {
+				case sig == nil:
+				case sig.Results().Len() == len(node.Results):
+					for i, result := range node.Results {
+						l.assign(sig.Results().At(i).Type(), result)
+					}
+				case len(node.Results) == 1:
+					// return load()
+					dsts := make([]types.Type, sig.Results().Len())
+					for i := range dsts {
+						dsts[i] = sig.Results().At(i).Type()
+					}
+					l.assignTuple(dsts, node.Results[0])
+				}
+			case *ast.SendStmt:
+				if ch, ok := info.TypeOf(node.Chan).Underlying().(*types.Chan); ok {
+					l.assign(ch.Elem(), node.Value)
+				}
+			case *ast.CompositeLit:
+				l.compositeLit(node)
+			}
+			return true
+		})
+	}
+
+	// Field order is part of the identity of a struct type, so a type
+	// identical to one of ours must keep its order.
+	var unnamed []*types.Struct
+	seen := make(map[types.Type]bool)
+	for expr, tv := range info.Types {
+		if strct, ok := expr.(*ast.StructType); ok && l.declared(strct) {
+			continue
+		}
+		l.unnamedStructs(tv.Type, &unnamed, seen)
+	}
+	for _, obj := range info.Defs {
+		if obj != nil {
+			l.unnamedStructs(obj.Type(), &unnamed, seen)
+		}
+	}
+	for named := range l.candidates {
+		for _, strct := range unnamed {
+			if types.Identical(named.Underlying(), strct) {
+				l.fix(named)
+				break
+			}
+		}
+	}
+
+	if l.tf.pkg.Name() != "main" {
+		scope := l.tf.pkg.Scope()
+		for _, name := range scope.Names() {
+			obj := scope.Lookup(name)
+			if obj.Exported() {
+				l.fix(obj.Type())
+			}
+			if named, ok := obj.Type().(*types.Named); ok {
+				for i := 0; i < named.NumMethods(); i++ {
+					if method := named.Method(i); method.Exported() {
+						l.fix(method.Type())
+					}
+				}
+			}
+		}
+	}
+}
+
+// declared reports whether a struct type expression declares one of the
+// candidate types.
+func (l *fieldLayouts) declared(strct *ast.StructType) bool {
+	for _, decl := range l.candidates {
+		if decl == strct {
+			return true
+		}
+	}
+	return false
+}
+
+// unnamedStructs appends the unnamed struct types within a type, not counting
+// the underlying types of named types.
+func (l *fieldLayouts) unnamedStructs(typ types.Type, list *[]*types.Struct, seen map[types.Type]bool) {
+	if typ == nil || seen[typ] {
+		return
+	}
+	seen[typ] = true
+	switch typ := typ.(type) {
+	case *types.Struct:
+		*list = append(*list, typ)
+		for i := 0; i < typ.NumFields(); i++ {
+			l.unnamedStructs(typ.Field(i).Type(), list, seen)
+		}
+	case *types.Pointer:
+		l.unnamedStructs(typ.Elem(), list, seen)
+	case *types.Slice:
+		l.unnamedStructs(typ.Elem(), list, seen)
+	case *types.Array:
+		l.unnamedStructs(typ.Elem(), list, seen)
+	case *types.Map:
+		l.unnamedStructs(typ.Key(), list, seen)
+		l.unnamedStructs(typ.Elem(), list, seen)
+	case *types.Chan:
+		l.unnamedStructs(typ.Elem(), list, seen)
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{typ.Params(), typ.Results()} {
+			for i := 0; i < tuple.Len(); i++ {
+				l.unnamedStructs(tuple.At(i).Type(), list, seen)
+			}
+		}
+	}
+}
+
+// fix marks the struct types within a type as fixed.
+func (l *fieldLayouts) fix(typ types.Type) {
+	if l.seen == nil {
+		l.seen = make(map[types.Type]bool)
+	}
+	if typ == nil || l.seen[typ] {
+		return
+	}
+	l.seen[typ] = true
+	switch typ := typ.(type) {
+	case *types.Named:
+		if l.candidates[typ] != nil {
+			l.fixed[typ] = true
+		}
+		l.fix(typ.Underlying())
+	case *types.Struct:
+		for i := 0; i < typ.NumFields(); i++ {
+			l.fix(typ.Field(i).Type())
+		}
+	case *types.Pointer:
+		l.fix(typ.Elem())
+	case *types.Slice:
+		l.fix(typ.Elem())
+	case *types.Array:
+		l.fix(typ.Elem())
+	case *types.Map:
+		l.fix(typ.Key())
+		l.fix(typ.Elem())
+	case *types.Chan:
+		l.fix(typ.Elem())
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{typ.Params(), typ.Results()} {
+			for i := 0; i < tuple.Len(); i++ {
+				l.fix(tuple.At(i).Type())
+			}
+		}
+	}
+}
+
+// assign handles a value being assigned to a destination of a type, which
+// might be an interface.
+func (l *fieldLayouts) assign(dst types.Type, value ast.Expr) {
+	if dst != nil && types.IsInterface(dst) {
+		l.fix(l.tf.info.TypeOf(value))
+	}
+}
+
+// assignTuple handles the multiple values of a call, or of a comma-ok
+// expression, being assigned to destinations of the given types, in order.
+func (l *fieldLayouts) assignTuple(dsts []types.Type, value ast.Expr) {
+	tuple, ok := l.tf.info.TypeOf(value).(*types.Tuple)
+	if !ok {
+		return
+	}
+	for i := 0; i < tuple.Len() && i < len(dsts); i++ {
+		if dsts[i] != nil && types.IsInterface(dsts[i]) {
+			l.fix(tuple.At(i).Type())
+		}
+	}
+}
+
+func (l *fieldLayouts) call(call *ast.CallExpr) {
+	info := l.tf.info
+	tv := info.Types[call.Fun]
+	switch {
+	case tv.IsType():
+		if len(call.Args) != 1 {
+			return
+		}
+		from := info.TypeOf(call.Args[0])
+		l.assign(tv.Type, call.Args[0])
+		if from == nil {
+			return
+		}
+		if isUnsafePointer(tv.Type) || isUnsafePointer(from) {
+			l.fix(tv.Type)
+			l.fix(from)
+		}
+		_, fromStruct := from.Underlying().(*types.Struct)
+		_, toStruct := tv.Type.Underlying().(*types.Struct)
+		if fromStruct && toStruct {
+			l.fix(tv.Type)
+			l.fix(from)
+		}
+	case tv.IsBuiltin():
+		ident, ok := astutil.Unparen(call.Fun).(*ast.Ident)
+		if sel, isSel := astutil.Unparen(call.Fun).(*ast.SelectorExpr); isSel {
+			ident, ok = sel.Sel, true
+		}
+		if !ok {
+			return
+		}
+		switch obj := info.Uses[ident]; {
+		case obj.Pkg() != nil && obj.Pkg().Path() == "unsafe":
+			// Offsetof, Sizeof, and Alignof.
+			ast.Inspect(call.Args[0], func(node ast.Node) bool {
+				if expr, ok := node.(ast.Expr); ok {
+					l.fix(info.TypeOf(expr))
+				}
+				return true
+			})
+		case obj.Name() == "append" && len(call.Args) > 1 && !call.Ellipsis.IsValid():
+			if slice, ok := info.TypeOf(call.Args[0]).Underlying().(*types.Slice); ok {
+				for _, arg := range call.Args[1:] {
+					l.assign(slice.Elem(), arg)
+				}
+			}
+		}
+	default:
+		sig, ok := info.TypeOf(call.Fun).Underlying().(*types.Signature)
+		if !ok {
+			return
+		}
+		params := sig.Params()
+		paramType := func(i int) types.Type {
+			switch {
+			case sig.Variadic() && i >= params.Len()-1:
+				param := params.At(params.Len() - 1).Type()
+				if !call.Ellipsis.IsValid() {
+					param = param.(*types.Slice).Elem()
+				}
+				return param
+			case i < params.Len():
+				return params.At(i).Type()
+			}
+			return nil
+		}
+		for i, arg := range call.Args {
+			l.assign(paramType(i), arg)
+		}
+		if len(call.Args) == 1 {
+			// f(load())
+			if tuple, ok := info.TypeOf(call.Args[0]).(*types.Tuple); ok {
+				dsts := make([]types.Type, tuple.Len())
+				for i := range dsts {
+					dsts[i] = paramType(i)
+				}
+				l.assignTuple(dsts, call.Args[0])
+			}
+		}
+		// The addresses given to sync/atomic must be aligned.
+		if fn := calleeFunc(info, call); fn != nil && fn.Pkg() != nil && fn.Pkg().Path() == "sync/atomic" {
+			for _, arg := range call.Args {
+				ast.Inspect(arg, func(node ast.Node) bool {
+					if sel, ok := node.(*ast.SelectorExpr); ok {
+						l.fix(info.TypeOf(sel.X))
+					}
+					return true
+				})
+			}
+		}
+	}
+}
+
+func (l *fieldLayouts) compositeLit(lit *ast.CompositeLit) {
+	info := l.tf.info
+	typ := info.TypeOf(lit)
+	if typ == nil {
+		return
+	}
+	for i, elt := range lit.Elts {
+		key, value := ast.Expr(nil), elt
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			key, value = kv.Key, kv.Value
+		}
+		switch under := typ.Underlying().(type) {
+		case *types.Slice:
+			l.assign(under.Elem(), value)
+		case *types.Array:
+			l.assign(under.Elem(), value)
+		case *types.Map:
+			l.assign(under.Key(), key)
+			l.assign(under.Elem(), value)
+		case *types.Struct:
+			if ident, ok := key.(*ast.Ident); ok {
+				if field, ok := info.Uses[ident].(*types.Var); ok {
+					l.assign(field.Type(), value)
+				}
+			} else if key == nil && i < under.NumFields() {
+				l.assign(under.Field(i).Type(), value)
+			}
+		}
+	}
+}
+
+func isUnsafePointer(typ types.Type) bool {
+	basic, ok := typ.Underlying().(*types.Basic)
+	return ok && basic.Kind() == types.UnsafePointer
+}
+
+// calleeFunc returns the function or method called by a call expression, if it
+// is known statically.
+func calleeFunc(info *types.Info, call *ast.CallExpr) *types.Func {
+	var ident *ast.Ident
+	switch fun := astutil.Unparen(call.Fun).(type) {
+	case *ast.Ident:
+		ident = fun
+	case *ast.SelectorExpr:
+		ident = fun.Sel
+	}
+	fn, _ := info.Uses[ident].(*types.Func)
+	return fn
+}
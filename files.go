@@ -0,0 +1,391 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Binject/debug/goobj2"
+)
+
+// fileGroup is one of the new files which the files of a package are
+// regrouped into with -shufflefiles.
+type fileGroup struct {
+	name  string
+	parts []filePart
+}
+
+// filePart is one of the parts an original file is split into.
+type filePart struct {
+	file  int // index of the original file
+	part  int
+	parts int
+}
+
+// origNames returns the original file names of a group, such as
+// "main.go+util.go#2" when it holds all of main.go and the second part of
+// util.go.
+func (g fileGroup) origNames(names []string) string {
+	var list []string
+	for _, part := range g.parts {
+		name := names[part.file]
+		if part.parts > 1 {
+			name = fmt.Sprintf("%s#%d", name, part.part+1)
+		}
+		list = append(list, name)
+	}
+	return strings.Join(list, "+")
+}
+
+// planFileGroups decides how the files of a package are merged, split,
+// reordered, and renamed with -shufflefiles. The files marked as whole, such as
+// those with dot imports, are kept as they are, only renamed and reordered.
+//
+// The plan only depends on the given randomness and file names.
+func planFileGroups(rand *mathrand.Rand, actionID []byte, names []string, whole []bool) []fileGroup {
+	sorted := make([]int, len(names))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.Slice(sorted, func(i, j int) bool { return names[sorted[i]] < names[sorted[j]] })
+
+	var groups []fileGroup
+	merging := false
+	for _, n := range rand.Perm(len(sorted)) {
+		i := sorted[n]
+		if whole[i] {
+			groups = append(groups, fileGroup{parts: []filePart{{file: i, parts: 1}}})
+			merging = false
+			continue
+		}
+		parts := 1
+		if rand.Intn(3) == 0 {
+			parts = 2
+		}
+		for part := 0; part < parts; part++ {
+			if !merging || rand.Intn(2) == 0 {
+				groups = append(groups, fileGroup{})
+			}
+			last := &groups[len(groups)-1]
+			last.parts = append(last.parts, filePart{file: i, part: part, parts: parts})
+			merging = true
+		}
+	}
+	for i := range groups {
+		groups[i].name = hashWith(actionID, groups[i].origNames(names)) + ".go"
+	}
+	return groups
+}
+
+// hasDotImport reports whether a file has a dot import, whose uses we can't
+// tell apart from other names.
+func hasDotImport(file *ast.File) bool {
+	for _, spec := range file.Imports {
+		if spec.Name != nil && spec.Name.Name == "." {
+			return true
+		}
+	}
+	return false
+}
+
+// shuffleFiles regroups the files of the current package as planned by
+// planFileGroups, returning the new files along with their detached comments
+// and names. The files of cgo packages are only renamed, keeping the prefix for
+// the generated files.
+//
+// Since the order of the files changes, all init functions are replaced by
+// regular functions, which a single new init function calls in the original
+// order.
+func (tf *transformer) shuffleFiles(files []*ast.File, detached [][]string, names []string) ([]*ast.File, [][]string, []string) {
+	tf.fileNames = make(map[string]string)
+	newNames := make([]string, len(names))
+	cgo := false
+	for i, name := range names {
+		newNames[i] = hashWith(curActionID, name) + ".go"
+		if strings.HasPrefix(name, "_cgo_") {
+			newNames[i] = "_cgo_" + newNames[i]
+			cgo = true
+		}
+	}
+	if cgo {
+		for i, name := range names {
+			tf.fileNames[newNames[i]] = name
+		}
+		return files, detached, newNames
+	}
+
+	whole := make([]bool, len(files))
+	for i, file := range files {
+		whole[i] = hasDotImport(file)
+	}
+	groups := planFileGroups(newRand("files", ""), curActionID, names, whole)
+	for _, group := range groups {
+		tf.fileNames[group.name] = group.origNames(names)
+	}
+
+	// Record the paths of the imports, and the blank ones. Code added by
+	// earlier steps, such as the literal cache, may refer to an import
+	// without type information, or add such an import; resolve them by name.
+	importPaths := make(map[*types.PkgName]string)
+	var blankImports []string
+	for _, file := range files {
+		byName := make(map[string]*types.PkgName)
+		for _, spec := range file.Imports {
+			var obj types.Object
+			switch {
+			case spec.Name != nil && spec.Name.Name == "_":
+				blankImports = append(blankImports, spec.Path.Value)
+				continue
+			case spec.Name != nil:
+				obj = tf.info.Defs[spec.Name]
+			default:
+				obj = tf.info.Implicits[spec]
+			}
+			if obj == nil && (spec.Name == nil || spec.Name.Name != ".") {
+				importPath, err := strconv.Unquote(spec.Path.Value)
+				if err != nil {
+					panic(err) // shouldn't happen
+				}
+				name := path.Base(importPath)
+				if spec.Name != nil {
+					name = spec.Name.Name
+				}
+				obj = types.NewPkgName(spec.Pos(), tf.pkg, name, types.NewPackage(importPath, path.Base(importPath)))
+			}
+			if obj, ok := obj.(*types.PkgName); ok {
+				importPaths[obj] = spec.Path.Value
+				byName[obj.Name()] = obj
+			}
+		}
+		ast.Inspect(file, func(node ast.Node) bool {
+			sel, ok := node.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && tf.info.ObjectOf(x) == nil && byName[x.Name] != nil {
+				tf.info.Uses[x] = byName[x.Name]
+			}
+			return true
+		})
+	}
+
+	// Turn the init functions into regular ones.
+	var initCalls []ast.Stmt
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Name.Name != "init" {
+				continue
+			}
+			obj := types.NewFunc(token.NoPos, tf.pkg, tf.globalName(files, "initFunc"), types.NewSignature(nil, nil, nil, false))
+			fn.Name = ast.NewIdent(obj.Name())
+			tf.info.Defs[fn.Name] = obj
+			call := ast.NewIdent(obj.Name())
+			tf.info.Uses[call] = obj
+			initCalls = append(initCalls, &ast.ExprStmt{X: &ast.CallExpr{Fun: call}})
+		}
+	}
+
+	// Split the declarations of each file into its parts.
+	partDecls := make(map[filePart][]ast.Decl)
+	for _, group := range groups {
+		for _, part := range group.parts {
+			partDecls[part] = nil
+		}
+	}
+	for i, file := range files {
+		rand := newRand("files", names[i])
+		parts := 1
+		for part := range partDecls {
+			if part.file == i {
+				parts = part.parts
+			}
+		}
+		for _, decl := range file.Decls {
+			if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.IMPORT {
+				continue
+			}
+			part := filePart{file: i, part: rand.Intn(parts), parts: parts}
+			partDecls[part] = append(partDecls[part], decl)
+		}
+	}
+
+	var newFiles []*ast.File
+	var newDetached [][]string
+	newNames = newNames[:0]
+	for n, group := range groups {
+		var decls []ast.Decl
+		var comments []string
+		blank := make(map[string]bool)
+		if n == 0 {
+			for _, path := range blankImports {
+				blank[path] = true
+			}
+			if len(initCalls) > 0 {
+				decls = append(decls, &ast.FuncDecl{
+					Name: ast.NewIdent("init"),
+					Type: &ast.FuncType{Params: &ast.FieldList{}},
+					Body: &ast.BlockStmt{List: initCalls},
+				})
+			}
+		}
+		for _, part := range group.parts {
+			decls = append(decls, partDecls[part]...)
+			if part.part == 0 {
+				// Directives like go:linkname go with the first
+				// part, without the trailing line directive.
+				list := detached[part.file]
+				comments = append(comments, list[:len(list)-2]...)
+			}
+		}
+		for _, comment := range comments {
+			if strings.HasPrefix(comment, "//go:linkname") {
+				blank[strconv.Quote("unsafe")] = true
+			}
+		}
+		for _, decl := range decls {
+			if decl, ok := decl.(*ast.GenDecl); ok && decl.Doc != nil {
+				for _, comment := range decl.Doc.List {
+					if strings.HasPrefix(comment.Text, "//go:embed") {
+						blank[strconv.Quote("embed")] = true
+					}
+				}
+			}
+		}
+		comments = append(comments, "", "//line :1")
+
+		// Files with dot imports keep their own imports.
+		var imports []*ast.ImportSpec
+		if part := group.parts[0]; whole[part.file] {
+			imports = files[part.file].Imports
+		} else {
+			imports = tf.groupImports(files, decls, importPaths)
+		}
+		for _, spec := range imports {
+			delete(blank, spec.Path.Value)
+		}
+		var blankPaths []string
+		for path := range blank {
+			blankPaths = append(blankPaths, path)
+		}
+		sort.Strings(blankPaths)
+		for _, path := range blankPaths {
+			imports = append(imports, &ast.ImportSpec{
+				Name: ast.NewIdent("_"),
+				Path: &ast.BasicLit{Kind: token.STRING, Value: path},
+			})
+		}
+		file := &ast.File{Name: ast.NewIdent(files[0].Name.Name), Imports: imports}
+		for _, spec := range imports {
+			file.Decls = append(file.Decls, &ast.GenDecl{Tok: token.IMPORT, Specs: []ast.Spec{spec}})
+		}
+		file.Decls = append(file.Decls, decls...)
+
+		newFiles = append(newFiles, file)
+		newDetached = append(newDetached, comments)
+		newNames = append(newNames, group.name)
+	}
+	return newFiles, newDetached, newNames
+}
+
+// groupImports returns the imports needed by the declarations in a new file.
+// If two of them would have the same name, one is given a new name, which its
+// uses are changed to.
+func (tf *transformer) groupImports(files []*ast.File, decls []ast.Decl, importPaths map[*types.PkgName]string) []*ast.ImportSpec {
+	paths := make(map[string]string) // by name
+	renamed := make(map[*types.PkgName]string)
+	for _, decl := range decls {
+		ast.Inspect(decl, func(node ast.Node) bool {
+			ident, ok := node.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			obj, ok := tf.info.Uses[ident].(*types.PkgName)
+			if !ok {
+				return true
+			}
+			if name, ok := renamed[obj]; ok {
+				ident.Name = name
+				return true
+			}
+			path := importPaths[obj]
+			name := obj.Name()
+			if other, ok := paths[name]; ok && other != path {
+				name = tf.globalName(files, name)
+			}
+			paths[name] = path
+			renamed[obj] = name
+			ident.Name = name
+			return true
+		})
+	}
+	var names []string
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var specs []*ast.ImportSpec
+	for _, name := range names {
+		specs = append(specs, &ast.ImportSpec{
+			Name: ast.NewIdent(name),
+			Path: &ast.BasicLit{Kind: token.STRING, Value: paths[name]},
+		})
+	}
+	return specs
+}
+
+// fileNamesData encodes the file names recorded by shuffleFiles, to be added
+// to the object file.
+func (tf *transformer) fileNamesData() []byte {
+	var names []string
+	for name := range tf.fileNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", name, tf.fileNames[name])
+	}
+	return buf.Bytes()
+}
+
+// fileNamesOf returns the file names which -shufflefiles gave to a package,
+// mapped to the original ones, as read from its object file. This covers
+// whichever files were compiled, including test files.
+func fileNamesOf(pkgPath string) (map[string]string, error) {
+	names := make(map[string]string)
+	packagefile := buildInfo.imports[pkgPath].packagefile
+	if packagefile == "" {
+		return names, nil
+	}
+	importMap := func(importPath string) (objectPath string) {
+		return buildInfo.imports[importPath].packagefile
+	}
+	pkg, err := goobj2.Parse(packagefile, pkgPath, importMap)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range pkg.ArchiveMembers {
+		if member.ArchiveHeader.Name != headerFiles {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(member.ArchiveHeader.Data))
+		for scanner.Scan() {
+			if fields := strings.Split(scanner.Text(), "\t"); len(fields) == 2 {
+				names[fields[0]] = fields[1]
+			}
+		}
+	}
+	return names, nil
+}
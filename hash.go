@@ -7,12 +7,17 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"go/token"
 	"io"
+	mathrand "math/rand"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+
+	"mvdan.cc/garble/internal/literals"
 )
 
 const buildIDSeparator = "/"
@@ -111,14 +116,72 @@ func ownContentID(toolID []byte) (string, error) {
 		fmt.Fprintf(h, " GOPRIVATE=%s", envGoPrivate)
 	}
 	if opts.GarbleLiterals {
-		fmt.Fprintf(h, " -literals")
+		fmt.Fprintf(h, " -literals=%s", formatLiterals(opts.LiteralLevel, opts.LiteralOverrides))
+	}
+	if opts.LiteralMaxSize != literals.DefaultMaxSize {
+		fmt.Fprintf(h, " -literalmaxsize=%d", opts.LiteralMaxSize)
+	}
+	if opts.LiteralCache != literals.CacheNone {
+		fmt.Fprintf(h, " -literalcache=%s", opts.LiteralCache)
+	}
+	if opts.ControlFlow {
+		fmt.Fprintf(h, " -controlflow")
+	}
+	if opts.Opaque > 0 {
+		fmt.Fprintf(h, " -opaque=%d", opts.Opaque)
+	}
+	if opts.GarbleLiterals && privateEmbeds() {
+		// The embed package is only patched when it's needed.
+		fmt.Fprintf(h, " embedpatch")
+	}
+	if opts.MBA {
+		fmt.Fprintf(h, " -mba")
+	}
+	if opts.IndirectCalls {
+		fmt.Fprintf(h, " -indirectcalls")
+	}
+	if opts.ShuffleFields {
+		fmt.Fprintf(h, " -shufflefields")
+	}
+	if opts.ShuffleFiles {
+		fmt.Fprintf(h, " -shufflefiles")
+	}
+	if opts.MergePkgs != "" {
+		fmt.Fprintf(h, " -mergepkgs=%s", opts.MergePkgs)
+	}
+	if opts.Naming != "hash" {
+		fmt.Fprintf(h, " -naming=%s", opts.Naming)
+	}
+	if opts.PrivateMethods {
+		fmt.Fprintf(h, " -privatemethods")
 	}
 	if opts.Tiny {
 		fmt.Fprintf(h, " -tiny")
 	}
+	if opts.ModInfo {
+		fmt.Fprintf(h, " -modinfo")
+	}
+	if opts.Explain {
+		fmt.Fprintf(h, " -explain")
+	}
+	if opts.Report {
+		fmt.Fprintf(h, " -report")
+	}
 	if len(opts.Seed) > 0 {
 		fmt.Fprintf(h, " -seed=%x", opts.Seed)
 	}
+	if nameLength != 4 {
+		fmt.Fprintf(h, " namelength=%d", nameLength)
+	}
+	// The exported methods which are obfuscated depend on the whole build.
+	var methods []string
+	for name := range cache.PrivateMethods {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	for _, name := range methods {
+		fmt.Fprintf(h, " method:%s=%s", name, cache.PrivateMethods[name])
+	}
 
 	return hashToString(h.Sum(nil)), nil
 }
@@ -152,19 +215,25 @@ var (
 )
 
 func hashWith(salt []byte, name string) string {
+	return hashWithLength(salt, name, 4)
+}
+
+// nameLength is the number of hash characters in the new names of identifiers,
+// before any collisions make them longer. Tests shorten it to force collisions;
+// see TestMain.
+var nameLength = 4
+
+// hashWithLength is like hashWith, but with the given number of hash
+// characters, which is extended to avoid collisions; see uniqueNames.
+func hashWithLength(salt []byte, name string, length int) string {
 	if len(salt) == 0 {
 		panic("hashWith: empty salt")
 	}
 	if name == "" {
 		panic("hashWith: empty name")
 	}
-	const length = 4
 
-	d := sha256.New()
-	d.Write(salt)
-	d.Write(opts.Seed)
-	io.WriteString(d, name)
-	sum := nameBase64.EncodeToString(d.Sum(nil))
+	sum := nameBase64.EncodeToString(nameSum(salt, name))
 
 	// TODO: Just make the first letter uppercase or lowercase as needed.
 	// This is also not needed for non-names, like import paths.
@@ -173,3 +242,61 @@ func hashWith(salt []byte, name string) string {
 	}
 	return "z" + sum[:length]
 }
+
+// uniqueNames gives each name a new name via newName, such as a hash. If the
+// new name is reserved, or was given to an earlier name, newName is called again
+// with the next attempt, which must give a longer name. Collisions are described
+// in the returned log.
+//
+// The names are handled in sorted order, so that the result only depends on
+// the set of names.
+func uniqueNames(names []string, reserved map[string]bool, newName func(name string, attempt int) string) (_ map[string]string, log []string) {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	given := make(map[string]string, len(names))
+	newNames := make(map[string]string, len(names))
+	for _, name := range names {
+		for attempt := 0; ; attempt++ {
+			newName := newName(name, attempt)
+			if other, ok := given[newName]; ok {
+				log = append(log, fmt.Sprintf("%s: %s collides with %s", newName, name, other))
+				continue
+			}
+			if reserved[newName] {
+				log = append(log, fmt.Sprintf("%s: %s collides with an existing name", newName, name))
+				continue
+			}
+			given[newName] = name
+			newNames[name] = newName
+			break
+		}
+	}
+	return newNames, log
+}
+
+// nameSum returns the sha256 sum from which the new name for an identifier is
+// derived, given the same salt as hashWith.
+func nameSum(salt []byte, name string) []byte {
+	d := sha256.New()
+	d.Write(salt)
+	d.Write(opts.Seed)
+	io.WriteString(d, name)
+	return d.Sum(nil)
+}
+
+// newRand returns a deterministic source of randomness for one phase of the
+// obfuscation of a file in the current package, such as "literals" for
+// "main.go". It is derived from the seed, so that changes to one file or phase
+// don't alter the others. Without a seed, it's derived from the package's
+// action ID, which changes with any edit to the package, so only the phases and
+// files are kept apart.
+func newRand(phase, name string) *mathrand.Rand {
+	seed := opts.Seed
+	if len(seed) == 0 {
+		seed = curActionID
+	}
+	d := sha256.New()
+	d.Write(seed)
+	fmt.Fprintf(d, " %s %s %s", curPkgPath, phase, name)
+	return mathrand.New(mathrand.NewSource(int64(binary.BigEndian.Uint64(d.Sum(nil)))))
+}
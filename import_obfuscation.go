@@ -172,6 +172,19 @@ func obfuscateImports(objPath string, importMap goobj2.ImportMap) (garbledObj st
 		}
 	}
 
+	var privatePaths []string
+	for pkgPath := range importCfg.Packages {
+		if isPrivate(pkgPath) {
+			privatePaths = append(privatePaths, pkgPath)
+		}
+	}
+	if collisions := setImportHashes(privatePaths); len(collisions) > 0 && opts.DebugDir != "" {
+		data := strings.Join(collisions, "\n") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(opts.DebugDir, "garble_collisions.txt"), []byte(data), 0o644); err != nil {
+			return "", err
+		}
+	}
+
 	var sb strings.Builder
 	var buf bytes.Buffer
 
@@ -437,8 +450,46 @@ func dedupPrivateNames(names []privateName) []privateName {
 	return names[:j]
 }
 
+// importHashes holds the hashed import paths of the private packages being
+// linked, by import path; see setImportHashes.
+var importHashes map[string]string
+
+// setImportHashes hashes the import paths of the given private packages, as
+// well as "main" for the main package, into importHashes. Hashes which would
+// collide are made longer, as two packages with the same hashed path would end
+// up with the same symbol names. It returns a description of the collisions.
+//
+// Since the hashes depend on the whole set of packages, "garble reverse" must
+// use the same set, which is all the private packages in the binary.
+func setImportHashes(privatePaths []string) []string {
+	var paths []string
+	for _, path := range append(privatePaths, "main") {
+		if len(importActionID(path)) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	var log []string
+	importHashes, log = uniqueNames(paths, nil, func(path string, attempt int) string {
+		return hashWithLength(importActionID(path), path, 4+attempt)
+	})
+	return log
+}
+
+// importActionID returns the action ID with which an import path is hashed.
+func importActionID(path string) []byte {
+	if path == "main" {
+		// The main package is known under its import path in the
+		// import config map.
+		path = buildInfo.firstImport
+	}
+	return buildInfo.imports[path].actionID
+}
+
 func hashImport(pkg string, seed []byte) string {
 	if len(seed) == 0 {
+		if hashed, ok := importHashes[pkg]; ok {
+			return hashed
+		}
 		pkgPath := pkg
 		if pkgPath == "main" {
 			// The main package is known under its import path in
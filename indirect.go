@@ -0,0 +1,358 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// callTable is a package-level array of functions with the same signature,
+// declared in the file of the functions it holds.
+type callTable struct {
+	name  string
+	file  *ast.File
+	typ   *ast.FuncType
+	funcs []*types.Func
+	calls map[*types.Func][]*ast.CallExpr
+}
+
+// indirectCalls rewrites the calls to unexported top-level functions in a
+// package into calls through tables of functions, such as tbl[key^3](x) for
+// f(x), so that the call graph isn't obvious from the binary. Each table is
+// filled by an init function which runs before any other, and key is a
+// package-level variable whose value the compiler can't assume.
+//
+// Calls from code which may run while the package-level variables are being
+// initialized are left alone, as the tables are still empty at that point.
+// So are calls to functions with compiler directives or go:linkname, which
+// might rely on being called directly, and to generic functions. Methods are
+// never rewritten, nor are function values.
+func (tf *transformer) indirectCalls(files []*ast.File, paths []string) {
+	if len(files) == 0 {
+		return
+	}
+	rand := newRand("indirect", "")
+
+	linknamed := make(map[string]bool)
+	decls := make(map[*types.Func]*ast.FuncDecl)
+	fileOf := make(map[*types.Func]*ast.File)
+	for i, file := range files {
+		for _, group := range file.Comments {
+			for _, comment := range group.List {
+				if fields := strings.Fields(comment.Text); len(fields) >= 2 && fields[0] == "//go:linkname" {
+					linknamed[fields[1]] = true
+				}
+			}
+		}
+		if strings.HasPrefix(filepath.Base(paths[i]), "_cgo_") {
+			continue
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			if obj, ok := tf.info.Defs[fn.Name].(*types.Func); ok {
+				decls[obj] = fn
+				fileOf[obj] = file
+			}
+		}
+	}
+	atInit := tf.funcsAtInit(files, decls)
+
+	type tableKey struct {
+		file *ast.File
+		sig  string
+	}
+	tables := make(map[tableKey]*callTable)
+	var order []*callTable
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			caller, ok := decl.(*ast.FuncDecl)
+			if !ok || caller.Body == nil || hasCompilerDirective(caller.Doc) {
+				continue
+			}
+			if obj, ok := tf.info.Defs[caller.Name].(*types.Func); ok && atInit[obj] {
+				continue
+			}
+			ast.Inspect(caller.Body, func(node ast.Node) bool {
+				call, ok := node.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				ident, ok := astutil.Unparen(call.Fun).(*ast.Ident)
+				if !ok {
+					return true
+				}
+				callee, ok := tf.info.Uses[ident].(*types.Func)
+				if !ok || decls[callee] == nil {
+					return true
+				}
+				fn := decls[callee]
+				if fn.Recv != nil || fn.Body == nil || ident.IsExported() || linknamed[ident.Name] ||
+					hasCompilerDirective(fn.Doc) {
+					return true
+				}
+				// A generic function is only identical to its type
+				// once instantiated.
+				if !types.Identical(tf.info.TypeOf(call.Fun), callee.Type()) {
+					return true
+				}
+				file := fileOf[callee]
+				key := tableKey{file, types.TypeString(callee.Type(), nil)}
+				table := tables[key]
+				if table == nil {
+					typ := tf.cloneFuncType(fn.Type)
+					if typ == nil {
+						return true
+					}
+					table = &callTable{file: file, typ: typ, calls: make(map[*types.Func][]*ast.CallExpr)}
+					tables[key] = table
+					order = append(order, table)
+				}
+				if table.calls[callee] == nil {
+					table.funcs = append(table.funcs, callee)
+				}
+				table.calls[callee] = append(table.calls[callee], call)
+				return true
+			})
+		}
+	}
+	if len(order) == 0 {
+		return
+	}
+
+	keyName := tf.globalName(files, "callKey")
+	keyVar := types.NewVar(token.NoPos, tf.pkg, keyName, types.Typ[types.Int])
+	keyValue := rand.Intn(1 << 30)
+	newIdent := func(obj types.Object) *ast.Ident {
+		ident := ast.NewIdent(obj.Name())
+		tf.info.Uses[ident] = obj
+		return ident
+	}
+
+	var fill []ast.Stmt
+	for _, table := range order {
+		table.name = tf.globalName(files, "callTable")
+		rand.Shuffle(len(table.funcs), func(i, j int) {
+			table.funcs[i], table.funcs[j] = table.funcs[j], table.funcs[i]
+		})
+		typ := types.NewArray(table.funcs[0].Type(), int64(len(table.funcs)))
+		tableVar := types.NewVar(token.NoPos, tf.pkg, table.name, typ)
+		for i, callee := range table.funcs {
+			fill = append(fill, &ast.AssignStmt{
+				Lhs: []ast.Expr{&ast.IndexExpr{X: newIdent(tableVar), Index: ah.IntLit(i)}},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{newIdent(callee)},
+			})
+			for _, call := range table.calls[callee] {
+				call.Fun = &ast.IndexExpr{
+					X:     newIdent(tableVar),
+					Index: binaryExpr(newIdent(keyVar), token.XOR, ah.IntLit(keyValue^i)),
+				}
+			}
+		}
+		name := ast.NewIdent(table.name)
+		tf.info.Defs[name] = tableVar
+		table.file.Decls = append(table.file.Decls, &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names: []*ast.Ident{name},
+				Type:  &ast.ArrayType{Len: ah.IntLit(len(table.funcs)), Elt: table.typ},
+			}},
+		})
+	}
+
+	// Go runs init functions in the order they appear, and the first file is
+	// given to the compiler first. Imports must stay at the top.
+	keyIdent := ast.NewIdent(keyName)
+	tf.info.Defs[keyIdent] = keyVar
+	decls0 := files[0].Decls
+	i := 0
+	for i < len(decls0) {
+		if decl, ok := decls0[i].(*ast.GenDecl); !ok || decl.Tok != token.IMPORT {
+			break
+		}
+		i++
+	}
+	files[0].Decls = append(decls0[:i:i], &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{
+			Names:  []*ast.Ident{keyIdent},
+			Values: []ast.Expr{ah.IntLit(keyValue)},
+		}},
+	}, &ast.FuncDecl{
+		Name: ast.NewIdent("init"),
+		Type: &ast.FuncType{Params: &ast.FieldList{}},
+		Body: ah.BlockStmt(fill...),
+	})
+	files[0].Decls = append(files[0].Decls, decls0[i:]...)
+}
+
+// funcsAtInit returns the functions and methods in a package which might be
+// called while its package-level variables are being initialized.
+//
+// If any of the initializers calls a function, we can't tell which methods it
+// might call via interfaces, so all of them are included.
+func (tf *transformer) funcsAtInit(files []*ast.File, decls map[*types.Func]*ast.FuncDecl) map[*types.Func]bool {
+	reached := make(map[*types.Func]bool)
+	var queue []*types.Func
+	visit := func(node ast.Node) bool {
+		ident, ok := node.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if fn, ok := tf.info.Uses[ident].(*types.Func); ok && decls[fn] != nil && !reached[fn] {
+			reached[fn] = true
+			queue = append(queue, fn)
+		}
+		return true
+	}
+	calls := false
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				for _, value := range spec.(*ast.ValueSpec).Values {
+					ast.Inspect(value, func(node ast.Node) bool {
+						if call, ok := node.(*ast.CallExpr); ok && !tf.info.Types[call.Fun].IsType() {
+							calls = true
+						}
+						return visit(node)
+					})
+				}
+			}
+		}
+	}
+	if calls {
+		for fn, decl := range decls {
+			if decl.Recv != nil && !reached[fn] {
+				reached[fn] = true
+				queue = append(queue, fn)
+			}
+		}
+	}
+	for len(queue) > 0 {
+		fn := queue[0]
+		queue = queue[1:]
+		if body := decls[fn].Body; body != nil {
+			ast.Inspect(body, visit)
+		}
+	}
+	return reached
+}
+
+// cloneFuncType returns a copy of a function's type without parameter names,
+// or nil if it contains types which we can't copy.
+func (tf *transformer) cloneFuncType(typ *ast.FuncType) *ast.FuncType {
+	cloneFields := func(list *ast.FieldList) (*ast.FieldList, bool) {
+		if list == nil {
+			return nil, true
+		}
+		clone := &ast.FieldList{}
+		for _, field := range list.List {
+			for n := 0; n < len(field.Names) || n == 0; n++ {
+				typ := tf.cloneTypeExpr(field.Type)
+				if typ == nil {
+					return nil, false
+				}
+				clone.List = append(clone.List, &ast.Field{Type: typ})
+			}
+		}
+		return clone, true
+	}
+	params, ok := cloneFields(typ.Params)
+	if !ok {
+		return nil
+	}
+	results, ok := cloneFields(typ.Results)
+	if !ok {
+		return nil
+	}
+	return &ast.FuncType{Params: params, Results: results}
+}
+
+// cloneTypeExpr returns a copy of a type expression, or nil if it contains
+// types which we can't copy, such as non-empty struct types.
+func (tf *transformer) cloneTypeExpr(expr ast.Expr) ast.Expr {
+	all := func(exprs ...ast.Expr) bool {
+		for _, expr := range exprs {
+			if expr == nil {
+				return false
+			}
+		}
+		return true
+	}
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		ident := ast.NewIdent(expr.Name)
+		if obj := tf.info.Uses[expr]; obj != nil {
+			tf.info.Uses[ident] = obj
+		}
+		return ident
+	case *ast.BasicLit:
+		return &ast.BasicLit{Kind: expr.Kind, Value: expr.Value}
+	case *ast.ParenExpr:
+		if x := tf.cloneTypeExpr(expr.X); x != nil {
+			return &ast.ParenExpr{X: x}
+		}
+	case *ast.SelectorExpr:
+		x, sel := tf.cloneTypeExpr(expr.X), tf.cloneTypeExpr(expr.Sel)
+		if all(x, sel) {
+			return &ast.SelectorExpr{X: x, Sel: sel.(*ast.Ident)}
+		}
+	case *ast.StarExpr:
+		if x := tf.cloneTypeExpr(expr.X); x != nil {
+			return &ast.StarExpr{X: x}
+		}
+	case *ast.Ellipsis:
+		if elt := tf.cloneTypeExpr(expr.Elt); elt != nil {
+			return &ast.Ellipsis{Elt: elt}
+		}
+	case *ast.ArrayType:
+		elt := tf.cloneTypeExpr(expr.Elt)
+		if expr.Len == nil {
+			if elt != nil {
+				return &ast.ArrayType{Elt: elt}
+			}
+			break
+		}
+		if length := tf.cloneTypeExpr(expr.Len); all(length, elt) {
+			return &ast.ArrayType{Len: length, Elt: elt}
+		}
+	case *ast.MapType:
+		key, value := tf.cloneTypeExpr(expr.Key), tf.cloneTypeExpr(expr.Value)
+		if all(key, value) {
+			return &ast.MapType{Key: key, Value: value}
+		}
+	case *ast.ChanType:
+		if value := tf.cloneTypeExpr(expr.Value); value != nil {
+			return &ast.ChanType{Dir: expr.Dir, Value: value}
+		}
+	case *ast.FuncType:
+		if typ := tf.cloneFuncType(expr); typ != nil {
+			return typ
+		}
+	case *ast.InterfaceType:
+		if len(expr.Methods.List) == 0 {
+			return &ast.InterfaceType{Methods: &ast.FieldList{}}
+		}
+	case *ast.StructType:
+		if len(expr.Fields.List) == 0 {
+			return &ast.StructType{Fields: &ast.FieldList{}}
+		}
+	}
+	return nil
+}
@@ -26,6 +26,15 @@ func IntLit(value int) *ast.BasicLit {
 	}
 }
 
+// UintLit returns an ast.BasicLit of kind INT for an unsigned value, which
+// unlike IntLit can't overflow on 32-bit hosts
+func UintLit(value uint64) *ast.BasicLit {
+	return &ast.BasicLit{
+		Kind:  token.INT,
+		Value: strconv.FormatUint(value, 10),
+	}
+}
+
 // Float32Lit returns an ast.BasicLit of kind FLOAT, 32 bit
 func Float32Lit(value float32) *ast.BasicLit {
 	return &ast.BasicLit{
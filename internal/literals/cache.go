@@ -0,0 +1,245 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	mathrand "math/rand"
+	"strconv"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// Cache selects whether obfuscated literals are decoded once, instead of at
+// every use. Caching only applies to strings and numbers; byte slices are
+// mutable, so each use needs its own copy anyway.
+type Cache int
+
+const (
+	// CacheNone decodes literals at every use.
+	CacheNone Cache = iota
+
+	// CacheInit decodes each literal once, when the package is initialized.
+	CacheInit
+
+	// CacheLazy decodes each literal once, the first time it is used. If no
+	// file in the package imports sync, one of them is made to, so the
+	// package must be able to import sync.
+	CacheLazy
+)
+
+var cacheNames = [...]string{
+	CacheNone: "",
+	CacheInit: "init",
+	CacheLazy: "lazy",
+}
+
+func (c Cache) String() string { return cacheNames[c] }
+
+// ParseCache parses a cache mode name such as "lazy". The empty string means
+// CacheNone.
+func ParseCache(s string) (Cache, error) {
+	for c, name := range cacheNames {
+		if s == name {
+			return Cache(c), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown literals cache %q", s)
+}
+
+// literalCache hoists the decoders of a package's literals into package-level
+// declarations, so that each literal is decoded once. Identical literals share
+// the same declaration.
+type literalCache struct {
+	mode     Cache
+	syncFile *ast.File // a file which imports sync, with CacheLazy
+	syncName string    // how syncFile imports sync, or will import it
+
+	used  map[string]bool // names we must not declare
+	exprs map[cacheKey]func() ast.Expr
+	decls []ast.Decl
+}
+
+// cacheKey identifies a literal by its type and value.
+type cacheKey struct {
+	typ   string
+	value string
+}
+
+// newLiteralCache returns a cache for the given package files, or nil if
+// mode is CacheNone.
+func newLiteralCache(files []*ast.File, mode Cache) *literalCache {
+	if mode == CacheNone {
+		return nil
+	}
+	c := &literalCache{
+		mode:  mode,
+		used:  make(map[string]bool),
+		exprs: make(map[cacheKey]func() ast.Expr),
+	}
+	for _, file := range files {
+		// Any name declared or used in the package, including imports,
+		// could clash with our declarations.
+		ast.Inspect(file, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok {
+				c.used[ident.Name] = true
+			}
+			return true
+		})
+		if mode != CacheLazy || c.syncFile != nil {
+			continue
+		}
+		for _, imp := range file.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil || path != "sync" {
+				continue
+			}
+			switch {
+			case imp.Name == nil:
+				c.syncName = "sync"
+			case imp.Name.Name != "_" && imp.Name.Name != ".":
+				c.syncName = imp.Name.Name
+			default:
+				continue
+			}
+			c.syncFile = file
+			break
+		}
+	}
+	if mode == CacheLazy && c.syncFile == nil {
+		// addDecls adds the import if we end up using it.
+		c.syncName = "sync"
+		for i := 2; c.used[c.syncName]; i++ {
+			c.syncName = "sync" + strconv.Itoa(i)
+		}
+		c.used[c.syncName] = true
+	}
+	return c
+}
+
+// newName returns a random lower case name which isn't used in the package.
+// Being lower case, it can't clash with names from dot imports either.
+func (c *literalCache) newName(rand *mathrand.Rand) string {
+	for {
+		name := make([]byte, 6+rand.Intn(5))
+		for i := range name {
+			name[i] = nameChars[rand.Intn(26)]
+		}
+		s := string(name)
+		if c.used[s] || token.Lookup(s).IsKeyword() {
+			continue
+		}
+		c.used[s] = true
+		return s
+	}
+}
+
+// use returns an expression for a literal of the given type and value, whose
+// obfuscated decoder is returned by decoder. If decoder returns nil, so does
+// use. Any new names are picked with rand.
+//
+// If c is nil, the decoder is used as-is. Otherwise, it is declared once at
+// the package level.
+func (c *literalCache) use(rand *mathrand.Rand, typ, value string, decoder func() ast.Expr) ast.Expr {
+	if c == nil {
+		return decoder()
+	}
+	key := cacheKey{typ, value}
+	if expr, ok := c.exprs[key]; ok {
+		return expr()
+	}
+	decoded := decoder()
+	if decoded == nil {
+		return nil
+	}
+	name := c.newName(rand)
+	varSpec := func(name string, typ ast.Expr, value ast.Expr) ast.Spec {
+		spec := &ast.ValueSpec{Names: []*ast.Ident{ast.NewIdent(name)}, Type: typ}
+		if value != nil {
+			spec.Values = []ast.Expr{value}
+		}
+		return spec
+	}
+
+	var expr func() ast.Expr
+	switch c.mode {
+	case CacheInit:
+		// var name = decoded
+		c.decls = append(c.decls, &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{varSpec(name, nil, decoded)},
+		})
+		expr = func() ast.Expr { return ast.NewIdent(name) }
+	case CacheLazy:
+		// var (
+		// 	nameOnce sync.Once
+		// 	name     typ
+		// )
+		//
+		// func nameFunc() typ {
+		// 	nameOnce.Do(func() { name = decoded })
+		// 	return name
+		// }
+		once, fn := c.newName(rand), c.newName(rand)
+		c.decls = append(c.decls,
+			&ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{
+					varSpec(once, &ast.SelectorExpr{X: ast.NewIdent(c.syncName), Sel: ast.NewIdent("Once")}, nil),
+					varSpec(name, ast.NewIdent(typ), nil),
+				},
+			},
+			&ast.FuncDecl{
+				Name: ast.NewIdent(fn),
+				Type: &ast.FuncType{
+					Params:  &ast.FieldList{},
+					Results: &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent(typ)}}},
+				},
+				Body: ah.BlockStmt(
+					ah.ExprStmt(ah.CallExpr(
+						&ast.SelectorExpr{X: ast.NewIdent(once), Sel: ast.NewIdent("Do")},
+						&ast.FuncLit{
+							Type: &ast.FuncType{Params: &ast.FieldList{}},
+							Body: ah.BlockStmt(&ast.AssignStmt{
+								Lhs: []ast.Expr{ast.NewIdent(name)},
+								Tok: token.ASSIGN,
+								Rhs: []ast.Expr{decoded},
+							}),
+						},
+					)),
+					ah.ReturnStmt(ast.NewIdent(name)),
+				),
+			},
+		)
+		expr = func() ast.Expr { return ah.CallExpr(ast.NewIdent(fn)) }
+	}
+	c.exprs[key] = expr
+	return expr()
+}
+
+// addDecls adds the cached declarations to the package, which is the given
+// non-empty list of files. With CacheLazy, if no file imports sync, the first
+// one is made to.
+func (c *literalCache) addDecls(files []*ast.File) {
+	if c == nil || len(c.decls) == 0 {
+		return
+	}
+	file := files[0]
+	if c.syncFile != nil {
+		file = c.syncFile
+	} else if c.mode == CacheLazy {
+		spec := &ast.ImportSpec{Path: ah.StringLit("sync")}
+		if c.syncName != "sync" {
+			spec.Name = ast.NewIdent(c.syncName)
+		}
+		file.Imports = append(file.Imports, spec)
+		file.Decls = append([]ast.Decl{&ast.GenDecl{
+			Tok:   token.IMPORT,
+			Specs: []ast.Spec{spec},
+		}}, file.Decls...)
+	}
+	file.Decls = append(file.Decls, c.decls...)
+}
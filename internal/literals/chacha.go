@@ -0,0 +1,261 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"encoding/binary"
+	"go/ast"
+	"go/token"
+	"math/bits"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// chacha encrypts literals with ChaCha20, as specified in RFC 8439. Unlike the
+// other obfuscators, undoing it requires the key, which is itself obfuscated
+// by one of the other obfuscators.
+//
+// The decoder must be generated as plain Go code, since the package being
+// obfuscated cannot import any new packages.
+type chacha struct{}
+
+// check that the obfuscator interface is implemented
+var _ obfuscator = chacha{}
+
+// chachaConstants are the first four words of the ChaCha20 state.
+var chachaConstants = [4]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+
+// chachaQuarterRounds are the indexes of the column and diagonal rounds.
+var chachaQuarterRounds = [8][4]int{
+	{0, 4, 8, 12}, {1, 5, 9, 13}, {2, 6, 10, 14}, {3, 7, 11, 15},
+	{0, 5, 10, 15}, {1, 6, 11, 12}, {2, 7, 8, 13}, {3, 4, 9, 14},
+}
+
+// chachaBlock returns the key stream block for the given state, whose counter
+// word is already set.
+func chachaBlock(state *[16]uint32) (block [64]byte) {
+	x := *state
+	for i := 0; i < 10; i++ {
+		for _, q := range chachaQuarterRounds {
+			a, b, c, d := q[0], q[1], q[2], q[3]
+			x[a] += x[b]
+			x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+			x[c] += x[d]
+			x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+			x[a] += x[b]
+			x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+			x[c] += x[d]
+			x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+		}
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(block[4*i:], x[i]+state[i])
+	}
+	return block
+}
+
+// ChaChaXOR encrypts or decrypts data in place. The key material is the
+// 32-byte key followed by the 12-byte nonce.
+func ChaChaXOR(keyNonce []byte, data []byte) {
+	var state [16]uint32
+	copy(state[:4], chachaConstants[:])
+	for i := 0; i < 8; i++ {
+		state[4+i] = binary.LittleEndian.Uint32(keyNonce[4*i:])
+	}
+	// The nonce goes after the counter, at index 12.
+	for i := 0; i < 3; i++ {
+		state[13+i] = binary.LittleEndian.Uint32(keyNonce[32+4*i:])
+	}
+	for i := 0; i < len(data); i += 64 {
+		state[12] = uint32(i / 64)
+		block := chachaBlock(&state)
+		for j := 0; j < 64 && i+j < len(data); j++ {
+			data[i+j] ^= block[j]
+		}
+	}
+}
+
+func (chacha) obfuscate(gen *generator, data []byte) *ast.BlockStmt {
+	keyNonce := make([]byte, 32+12)
+	gen.randBytes(keyNonce)
+	ChaChaXOR(keyNonce, data)
+
+	// The key is obfuscated with another obfuscator, so that it can't be
+	// read as-is from the binary.
+	keyObfuscator := obfuscators[gen.rand.Intn(len(obfuscators))]
+
+	name := ast.NewIdent
+	assign := func(lhs ast.Expr, tok token.Token, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: tok, Rhs: []ast.Expr{rhs}}
+	}
+	return ah.BlockStmt(append([]ast.Stmt{
+		assign(name("key"), token.DEFINE, ah.LambdaCall(
+			&ast.ArrayType{Elt: name("byte")},
+			appendReturn(keyObfuscator.obfuscate(gen, keyNonce), name("data")),
+		)),
+		assign(name("data"), token.DEFINE, ah.DataToByteSlice(data)),
+	}, ChaChaDecrypt()...)...)
+}
+
+// ChaChaDecrypt returns the statements which decrypt the []byte variable named
+// data in place, given the []byte variable named key, which holds the 32-byte
+// key followed by the 12-byte nonce. The statements declare the variables s and
+// x, so they are best wrapped in a function of their own. The data can be
+// encrypted with ChaChaXOR.
+func ChaChaDecrypt() []ast.Stmt {
+	x := func(index ast.Expr) ast.Expr { return ah.IndexExpr("x", index) }
+	s := func(index ast.Expr) ast.Expr { return ah.IndexExpr("s", index) }
+	name := ast.NewIdent
+	assign := func(lhs ast.Expr, tok token.Token, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: tok, Rhs: []ast.Expr{rhs}}
+	}
+	rotate := func(v string, n int) ast.Expr {
+		// x[v] = x[v]<<n | x[v]>>(32-n)
+		return &ast.BinaryExpr{
+			X:  &ast.BinaryExpr{X: x(name(v)), Op: token.SHL, Y: ah.IntLit(n)},
+			Op: token.OR,
+			Y:  &ast.BinaryExpr{X: x(name(v)), Op: token.SHR, Y: ah.IntLit(32 - n)},
+		}
+	}
+	var quarterRound []ast.Stmt
+	for _, step := range [4]struct {
+		a, b, d string
+		n       int
+	}{{"a", "b", "d", 16}, {"c", "d", "b", 12}, {"a", "b", "d", 8}, {"c", "d", "b", 7}} {
+		quarterRound = append(quarterRound,
+			assign(x(name(step.a)), token.ADD_ASSIGN, x(name(step.b))),
+			assign(x(name(step.d)), token.XOR_ASSIGN, x(name(step.a))),
+			assign(x(name(step.d)), token.ASSIGN, rotate(step.d, step.n)),
+		)
+	}
+
+	var rounds []ast.Expr
+	for _, q := range chachaQuarterRounds {
+		rounds = append(rounds, &ast.CompositeLit{Elts: []ast.Expr{
+			ah.IntLit(q[0]), ah.IntLit(q[1]), ah.IntLit(q[2]), ah.IntLit(q[3]),
+		}})
+	}
+	var constants []ast.Expr
+	for _, c := range chachaConstants {
+		constants = append(constants, ah.UintLit(uint64(c)))
+	}
+
+	// for i := 0; i < count; i++ {
+	// 	s[stateOff+i] = uint32(key[keyOff+4*i]) | ... | uint32(key[keyOff+4*i+3])<<24
+	// }
+	loadWords := func(count, stateOff, keyOff int) ast.Stmt {
+		var word ast.Expr
+		for i := 0; i < 4; i++ {
+			off := &ast.BinaryExpr{
+				X:  &ast.BinaryExpr{X: ah.IntLit(4), Op: token.MUL, Y: name("i")},
+				Op: token.ADD,
+				Y:  ah.IntLit(keyOff + i),
+			}
+			var part ast.Expr = ah.CallExpr(name("uint32"), ah.IndexExpr("key", off))
+			if i > 0 {
+				part = &ast.BinaryExpr{X: part, Op: token.SHL, Y: ah.IntLit(8 * i)}
+				part = &ast.BinaryExpr{X: word, Op: token.OR, Y: part}
+			}
+			word = part
+		}
+		return &ast.ForStmt{
+			Init: assign(name("i"), token.DEFINE, ah.IntLit(0)),
+			Cond: &ast.BinaryExpr{X: name("i"), Op: token.LSS, Y: ah.IntLit(count)},
+			Post: &ast.IncDecStmt{X: name("i"), Tok: token.INC},
+			Body: ah.BlockStmt(assign(
+				s(&ast.BinaryExpr{X: ah.IntLit(stateOff), Op: token.ADD, Y: name("i")}),
+				token.ASSIGN, word,
+			)),
+		}
+	}
+
+	uint32Array := &ast.ArrayType{Len: ah.IntLit(16), Elt: name("uint32")}
+	ij := &ast.BinaryExpr{X: name("i"), Op: token.ADD, Y: name("j")}
+	return []ast.Stmt{
+		&ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names: []*ast.Ident{name("s"), name("x")},
+				Type:  uint32Array,
+			}},
+		}},
+		// s[0], s[1], s[2], s[3] = constants...
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{s(ah.IntLit(0)), s(ah.IntLit(1)), s(ah.IntLit(2)), s(ah.IntLit(3))},
+			Tok: token.ASSIGN,
+			Rhs: constants,
+		},
+		loadWords(8, 4, 0),
+		loadWords(3, 13, 32), // the nonce goes after the counter
+		// for i := 0; i < len(data); i += 64 { ... }
+		&ast.ForStmt{
+			Init: assign(name("i"), token.DEFINE, ah.IntLit(0)),
+			Cond: &ast.BinaryExpr{X: name("i"), Op: token.LSS, Y: ah.CallExpr(name("len"), name("data"))},
+			Post: assign(name("i"), token.ADD_ASSIGN, ah.IntLit(64)),
+			Body: ah.BlockStmt(
+				assign(s(ah.IntLit(12)), token.ASSIGN, ah.CallExpr(name("uint32"),
+					&ast.BinaryExpr{X: name("i"), Op: token.QUO, Y: ah.IntLit(64)})),
+				assign(name("x"), token.ASSIGN, name("s")),
+				&ast.ForStmt{
+					Init: assign(name("r"), token.DEFINE, ah.IntLit(0)),
+					Cond: &ast.BinaryExpr{X: name("r"), Op: token.LSS, Y: ah.IntLit(10)},
+					Post: &ast.IncDecStmt{X: name("r"), Tok: token.INC},
+					Body: ah.BlockStmt(&ast.RangeStmt{
+						Key:   name("_"),
+						Value: name("q"),
+						Tok:   token.DEFINE,
+						X: &ast.CompositeLit{
+							Type: &ast.ArrayType{
+								Len: ah.IntLit(len(rounds)),
+								Elt: &ast.ArrayType{Len: ah.IntLit(4), Elt: name("int")},
+							},
+							Elts: rounds,
+						},
+						Body: ah.BlockStmt(append([]ast.Stmt{&ast.AssignStmt{
+							Lhs: []ast.Expr{name("a"), name("b"), name("c"), name("d")},
+							Tok: token.DEFINE,
+							Rhs: []ast.Expr{
+								ah.IndexExpr("q", ah.IntLit(0)), ah.IndexExpr("q", ah.IntLit(1)),
+								ah.IndexExpr("q", ah.IntLit(2)), ah.IndexExpr("q", ah.IntLit(3)),
+							},
+						}}, quarterRound...)...),
+					}),
+				},
+				// for j := 0; j < 64 && i+j < len(data); j++ {
+				// 	data[i+j] ^= byte((x[j/4] + s[j/4]) >> (8 * (j % 4)))
+				// }
+				&ast.ForStmt{
+					Init: assign(name("j"), token.DEFINE, ah.IntLit(0)),
+					Cond: &ast.BinaryExpr{
+						X:  &ast.BinaryExpr{X: name("j"), Op: token.LSS, Y: ah.IntLit(64)},
+						Op: token.LAND,
+						Y:  &ast.BinaryExpr{X: ij, Op: token.LSS, Y: ah.CallExpr(name("len"), name("data"))},
+					},
+					Post: &ast.IncDecStmt{X: name("j"), Tok: token.INC},
+					Body: ah.BlockStmt(assign(ah.IndexExpr("data", ij), token.XOR_ASSIGN, ah.CallExpr(name("byte"),
+						&ast.BinaryExpr{
+							X: &ast.ParenExpr{X: &ast.BinaryExpr{
+								X:  x(&ast.BinaryExpr{X: name("j"), Op: token.QUO, Y: ah.IntLit(4)}),
+								Op: token.ADD,
+								Y:  s(&ast.BinaryExpr{X: name("j"), Op: token.QUO, Y: ah.IntLit(4)}),
+							}},
+							Op: token.SHR,
+							Y: &ast.ParenExpr{X: &ast.BinaryExpr{
+								X:  ah.IntLit(8),
+								Op: token.MUL,
+								Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: name("j"), Op: token.REM, Y: ah.IntLit(4)}},
+							}},
+						},
+					))),
+				},
+			),
+		},
+	}
+}
+
+// appendReturn adds a return statement to the end of a block.
+func appendReturn(block *ast.BlockStmt, result ast.Expr) *ast.BlockStmt {
+	block.List = append(block.List, ah.ReturnStmt(result))
+	return block
+}
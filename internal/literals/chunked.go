@@ -0,0 +1,95 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"go/ast"
+	"go/token"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// chunkSize is the number of bytes encrypted with each chunked seed.
+const chunkSize = 256
+
+// chunked obfuscates large literals in linear time. The data is split into
+// chunks, and each chunk is encrypted with the key stream of a xorshift
+// generator with its own seed. Unlike the other obfuscators, the size of the
+// decoder barely grows with the data, and decoding it only takes a few
+// operations per byte.
+type chunked struct{}
+
+// check that the obfuscator interface is implemented
+var _ obfuscator = chunked{}
+
+// xorshift32 advances a xorshift generator, whose state must not be zero.
+func xorshift32(state uint32) uint32 {
+	state ^= state << 13
+	state ^= state >> 17
+	state ^= state << 5
+	return state
+}
+
+func (chunked) obfuscate(gen *generator, data []byte) *ast.BlockStmt {
+	seeds := make([]ast.Expr, 0, (len(data)+chunkSize-1)/chunkSize)
+	op := gen.randOperator()
+
+	var state uint32
+	for i := range data {
+		if i%chunkSize == 0 {
+			state = gen.rand.Uint32() | 1
+			seeds = append(seeds, ah.UintLit(uint64(state)))
+		}
+		state = xorshift32(state)
+		data[i] = evalOperator(op, data[i], byte(state))
+	}
+
+	assign := func(lhs ast.Expr, tok token.Token, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: tok, Rhs: []ast.Expr{rhs}}
+	}
+	stateVar := ast.NewIdent("state")
+	shift := func(op token.Token, n int) ast.Stmt {
+		// state ^= state << n
+		return assign(stateVar, token.XOR_ASSIGN, &ast.BinaryExpr{X: stateVar, Op: op, Y: ah.IntLit(n)})
+	}
+	return ah.BlockStmt(
+		assign(ast.NewIdent("seeds"), token.DEFINE, &ast.CompositeLit{
+			Type: &ast.ArrayType{Elt: ast.NewIdent("uint32")},
+			Elts: seeds,
+		}),
+		assign(ast.NewIdent("data"), token.DEFINE, ah.DataToByteSlice(data)),
+		&ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names: []*ast.Ident{stateVar},
+				Type:  ast.NewIdent("uint32"),
+			}},
+		}},
+		&ast.RangeStmt{
+			Key: ast.NewIdent("i"),
+			Tok: token.DEFINE,
+			X:   ast.NewIdent("data"),
+			Body: ah.BlockStmt(
+				// if i%chunkSize == 0 { state = seeds[i/chunkSize] }
+				&ast.IfStmt{
+					Cond: &ast.BinaryExpr{
+						X:  &ast.BinaryExpr{X: ast.NewIdent("i"), Op: token.REM, Y: ah.IntLit(chunkSize)},
+						Op: token.EQL,
+						Y:  ah.IntLit(0),
+					},
+					Body: ah.BlockStmt(assign(stateVar, token.ASSIGN, ah.IndexExpr("seeds",
+						&ast.BinaryExpr{X: ast.NewIdent("i"), Op: token.QUO, Y: ah.IntLit(chunkSize)},
+					))),
+				},
+				shift(token.SHL, 13),
+				shift(token.SHR, 17),
+				shift(token.SHL, 5),
+				assign(ah.IndexExpr("data", ast.NewIdent("i")), token.ASSIGN, gen.reverseOp(op,
+					ah.IndexExpr("data", ast.NewIdent("i")),
+					ah.CallExpr(ast.NewIdent("byte"), stateVar),
+				)),
+			),
+		},
+	)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// constBlockToVar reports whether a whole const declaration can become a var
+// declaration, which is the case if it only declares typed basic constants
+// which don't need to be constant.
+func constBlockToVar(decl *ast.GenDecl, info *types.Info, ignoreObj map[types.Object]string) bool {
+	for _, spec := range decl.Specs {
+		spec, ok := spec.(*ast.ValueSpec)
+		if !ok {
+			return false
+		}
+
+		for _, name := range spec.Names {
+			obj := info.ObjectOf(name)
+
+			basic, ok := obj.Type().(*types.Basic)
+			if !ok {
+				// skip the block if it contains non basic types
+				return false
+			}
+
+			if basic.Info()&types.IsUntyped != 0 {
+				// skip the block if it contains untyped constants
+				return false
+			}
+
+			// The object cannot be obfuscated, e.g. a value that needs to be constant
+			if _, ok := ignoreObj[obj]; ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stringConsts returns the string constants which can safely become string
+// variables. That is, those which are used at least once, and only ever as
+// values of type string outside of constant expressions. Both untyped constants
+// and those of type string are included, so that they can be moved out of const
+// declarations which must stay, such as those with array lengths.
+//
+// Exported constants are never included, as other packages might need them to
+// be constant.
+func stringConsts(files []*ast.File, info *types.Info, ignoreObj map[types.Object]string) map[*types.Const]bool {
+	used := make(map[*types.Const]bool)
+	unsafe := make(map[*types.Const]bool)
+	var stack []ast.Node
+	visit := func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, node)
+
+		ident, ok := node.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj, ok := info.Uses[ident].(*types.Const)
+		if !ok || (obj.Type() != types.Typ[types.UntypedString] && obj.Type() != types.Typ[types.String]) {
+			return true
+		}
+		used[obj] = true
+		if obj.Exported() && obj.Parent() == obj.Pkg().Scope() {
+			unsafe[obj] = true
+		}
+		if _, ok := ignoreObj[obj]; ok {
+			unsafe[obj] = true
+		}
+		if info.TypeOf(ident) != types.Typ[types.String] {
+			unsafe[obj] = true // e.g. a named string type
+		}
+		if parent, ok := stack[len(stack)-2].(ast.Expr); ok && info.Types[parent].Value != nil {
+			unsafe[obj] = true // e.g. len(name) or name+"suffix"
+		}
+		for _, node := range stack {
+			if decl, ok := node.(*ast.GenDecl); ok && decl.Tok == token.CONST {
+				unsafe[obj] = true
+			}
+		}
+		return true
+	}
+	for _, file := range files {
+		ast.Inspect(file, visit)
+	}
+
+	safe := make(map[*types.Const]bool)
+	for obj := range used {
+		if !unsafe[obj] {
+			safe[obj] = true
+		}
+	}
+	return safe
+}
+
+// constsToVars moves the safe string constants out of a const
+// declaration, returning a var declaration with their obfuscated values. The
+// constants are replaced by blank names, so that iota and implicit repetition
+// keep working in the rest of the const declaration. Their values are also
+// emptied, unless the next spec repeats them.
+//
+// If no constants were moved, nil is returned.
+func constsToVars(rand *mathrand.Rand, decl *ast.GenDecl, info *types.Info, safe map[*types.Const]bool, level Level, cache *literalCache, maxSize int, stats *Stats) *ast.GenDecl {
+	var specs []ast.Spec
+	for j, spec := range decl.Specs {
+		spec := spec.(*ast.ValueSpec)
+		repeated := j+1 < len(decl.Specs) && len(decl.Specs[j+1].(*ast.ValueSpec).Values) == 0
+		for i, name := range spec.Names {
+			obj, ok := info.Defs[name].(*types.Const)
+			if !ok || !safe[obj] {
+				continue
+			}
+			value := constant.StringVal(obj.Val())
+			if value == "" {
+				continue
+			}
+			if len(value) > maxSize {
+				stats.recordTooLarge(name.Pos())
+				continue
+			}
+			// Keep the original identifier, which is the one that
+			// info.Defs knows about.
+			spec.Names[i] = ast.NewIdent("_")
+			if !repeated && i < len(spec.Values) {
+				spec.Values[i] = ah.StringLit("")
+			}
+			specs = append(specs, &ast.ValueSpec{
+				Names: []*ast.Ident{name},
+				Values: []ast.Expr{cache.use(rand, "string", value, func() ast.Expr {
+					obfuscator := randObfuscator(rand, level, len(value))
+					stats.recordObfuscated(obfuscator)
+					return obfuscateString(rand, obfuscator, value)
+				})},
+			})
+		}
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+	return &ast.GenDecl{Tok: token.VAR, Specs: specs}
+}
+
+// jumpedConsts returns the local const declarations which a goto jumps over.
+// They must stay as constants, as a goto may not jump over a variable
+// declaration.
+func jumpedConsts(files []*ast.File, info *types.Info) map[*ast.DeclStmt]bool {
+	labels := make(map[types.Object]token.Pos)
+	var gotos []*ast.BranchStmt
+	var decls []*ast.DeclStmt
+	for _, file := range files {
+		ast.Inspect(file, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.LabeledStmt:
+				labels[info.Defs[node.Label]] = node.Pos()
+			case *ast.BranchStmt:
+				if node.Tok == token.GOTO {
+					gotos = append(gotos, node)
+				}
+			case *ast.DeclStmt:
+				if decl := node.Decl.(*ast.GenDecl); decl.Tok == token.CONST {
+					decls = append(decls, node)
+				}
+			}
+			return true
+		})
+	}
+
+	jumped := make(map[*ast.DeclStmt]bool)
+	for _, decl := range decls {
+		for _, stmt := range gotos {
+			// Labels are scoped to their function, so a forward
+			// jump from before the declaration to after it must
+			// happen within the same function.
+			label := labels[info.Uses[stmt.Label]]
+			if stmt.Pos() < decl.Pos() && label > decl.End() {
+				jumped[decl] = true
+				break
+			}
+		}
+	}
+	return jumped
+}
@@ -0,0 +1,420 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+
+	"golang.org/x/tools/go/ast/astutil"
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// generator randomizes the shape of a single decoder, so that the decoders of
+// the same obfuscator don't share an instruction pattern. Obfuscators use it to
+// pick between equivalent chains of operations. The data is also masked with a
+// random chain of operations, undone at the end of the decoder with keys which
+// are computed in different ways, and finish then varies the loop shapes, the
+// variable declarations and their names.
+//
+// All of its randomness comes from rand, which is specific to the file being
+// obfuscated.
+type generator struct {
+	rand *mathrand.Rand
+	used map[string]bool
+}
+
+func newGenerator(rand *mathrand.Rand) *generator {
+	return &generator{rand: rand, used: make(map[string]bool)}
+}
+
+// decoderCall returns a call to a function literal which runs the decoder
+// generated by obfuscator for data, followed by tail. The tail can refer to the
+// decoded bytes as "data".
+func decoderCall(rand *mathrand.Rand, obfuscator obfuscator, data []byte, resultType ast.Expr, tail ...ast.Stmt) *ast.CallExpr {
+	gen := newGenerator(rand)
+	steps := gen.maskSteps()
+	masked := make([]byte, len(data))
+	for i, b := range data {
+		for _, step := range steps {
+			b = step.apply(i, b)
+		}
+		masked[i] = b
+	}
+	block := obfuscator.obfuscate(gen, masked)
+	gen.unmask(block, steps)
+	block.List = append(block.List, tail...)
+	return ah.LambdaCall(resultType, gen.finish(block))
+}
+
+const nameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// newName returns a random identifier which isn't used yet in the decoder, and
+// which doesn't shadow a keyword or a predeclared name like len.
+func (g *generator) newName() string {
+	for {
+		name := make([]byte, 2+g.rand.Intn(5))
+		for i := range name {
+			name[i] = nameChars[g.rand.Intn(len(nameChars))]
+		}
+		s := string(name)
+		if g.used[s] || token.Lookup(s).IsKeyword() || types.Universe.Lookup(s) != nil {
+			continue
+		}
+		g.used[s] = true
+		return s
+	}
+}
+
+// reverseOp is like operatorToReversedBinaryExpr, but it picks one of several
+// equivalent chains of operations. Both x and y must be byte expressions
+// without side effects, as they may be evaluated twice.
+func (g *generator) reverseOp(op token.Token, x, y ast.Expr) ast.Expr {
+	bin := func(x ast.Expr, op token.Token, y ast.Expr) ast.Expr {
+		return &ast.BinaryExpr{X: x, Op: op, Y: y}
+	}
+	paren := func(x ast.Expr) ast.Expr { return &ast.ParenExpr{X: x} }
+	switch g.rand.Intn(3) {
+	case 1:
+		switch op {
+		case token.XOR: // (x | y) &^ (x & y)
+			return bin(paren(bin(x, token.OR, y)), token.AND_NOT, paren(bin(x, token.AND, y)))
+		case token.ADD: // x + ^y + 1
+			return bin(bin(x, token.ADD, &ast.UnaryExpr{Op: token.XOR, X: y}), token.ADD, ah.IntLit(1))
+		case token.SUB: // x - ^y - 1
+			return bin(bin(x, token.SUB, &ast.UnaryExpr{Op: token.XOR, X: y}), token.SUB, ah.IntLit(1))
+		}
+	case 2:
+		switch op {
+		case token.XOR: // (x | y) - (x & y)
+			return bin(paren(bin(x, token.OR, y)), token.SUB, paren(bin(x, token.AND, y)))
+		case token.ADD: // -(y - x)
+			return &ast.UnaryExpr{Op: token.SUB, X: paren(bin(y, token.SUB, x))}
+		case token.SUB: // y + x
+			return bin(y, token.ADD, x)
+		}
+	}
+	return operatorToReversedBinaryExpr(op, x, y)
+}
+
+// finish randomizes a complete decoder. The decoder must only refer to its own
+// names and predeclared ones, and it must not use continue statements.
+func (g *generator) finish(block *ast.BlockStmt) *ast.BlockStmt {
+	astutil.Apply(block, nil, g.reshape)
+	g.rename(block)
+	return block
+}
+
+// reshape randomly rewrites loops and variable declarations into equivalent
+// forms.
+func (g *generator) reshape(cursor *astutil.Cursor) bool {
+	switch node := cursor.Node().(type) {
+	case *ast.RangeStmt:
+		// for i, b := range x { ... } becomes
+		// for i := 0; i < len(x); i++ { b := x[i]; ... }
+		x, ok := node.X.(*ast.Ident)
+		if !ok || node.Tok != token.DEFINE || g.rand.Intn(2) == 0 {
+			break
+		}
+		key, _ := node.Key.(*ast.Ident)
+		if key == nil || key.Name == "_" {
+			key = ast.NewIdent(g.newName())
+		}
+		body := node.Body
+		if value, _ := node.Value.(*ast.Ident); value != nil && value.Name != "_" {
+			body.List = append([]ast.Stmt{&ast.AssignStmt{
+				Lhs: []ast.Expr{value},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.IndexExpr{X: x, Index: key}},
+			}}, body.List...)
+		}
+		cursor.Replace(&ast.ForStmt{
+			Init: &ast.AssignStmt{Lhs: []ast.Expr{key}, Tok: token.DEFINE, Rhs: []ast.Expr{ah.IntLit(0)}},
+			Cond: &ast.BinaryExpr{X: key, Op: token.LSS, Y: ah.CallExpr(ast.NewIdent("len"), x)},
+			Post: &ast.IncDecStmt{X: key, Tok: token.INC},
+			Body: body,
+		})
+	case *ast.ForStmt:
+		// for init; cond; post { ... } becomes { init; for cond { ...; post } }
+		if node.Init == nil || node.Post == nil || g.rand.Intn(2) == 0 {
+			break
+		}
+		node.Body.List = append(node.Body.List, node.Post)
+		cursor.Replace(ah.BlockStmt(node.Init, &ast.ForStmt{Cond: node.Cond, Body: node.Body}))
+	case *ast.AssignStmt:
+		// x := y becomes var x = y
+		if node.Tok != token.DEFINE || len(node.Lhs) != 1 || len(node.Rhs) != 1 || g.rand.Intn(3) != 0 {
+			break
+		}
+		if _, ok := cursor.Parent().(*ast.BlockStmt); !ok {
+			break // e.g. the init statement of a loop
+		}
+		cursor.Replace(&ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names:  []*ast.Ident{node.Lhs[0].(*ast.Ident)},
+				Values: node.Rhs,
+			}},
+		}})
+	}
+	return true
+}
+
+// rename gives new random names to all the names declared in a decoder.
+func (g *generator) rename(block *ast.BlockStmt) {
+	var declared []*ast.Ident
+	declare := func(expr ast.Expr) {
+		if ident, ok := expr.(*ast.Ident); ok && ident.Name != "_" {
+			declared = append(declared, ident)
+		}
+	}
+	declareFields := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			for _, name := range field.Names {
+				declare(name)
+			}
+		}
+	}
+	ast.Inspect(block, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.AssignStmt:
+			if node.Tok == token.DEFINE {
+				for _, lhs := range node.Lhs {
+					declare(lhs)
+				}
+			}
+		case *ast.RangeStmt:
+			if node.Tok == token.DEFINE {
+				declare(node.Key)
+				declare(node.Value)
+			}
+		case *ast.ValueSpec:
+			for _, name := range node.Names {
+				declare(name)
+			}
+		case *ast.TypeSpec:
+			declare(node.Name)
+		case *ast.FuncType:
+			declareFields(node.Params)
+			declareFields(node.Results)
+		}
+		return true
+	})
+
+	// Reserve the old names first, so that a new name never matches an old
+	// one. That way, identifiers shared between nodes are only renamed once.
+	for _, ident := range declared {
+		g.used[ident.Name] = true
+	}
+	names := make(map[string]string)
+	for _, ident := range declared {
+		if _, ok := names[ident.Name]; !ok {
+			names[ident.Name] = g.newName()
+		}
+	}
+	ast.Inspect(block, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if name, ok := names[ident.Name]; ok {
+				ident.Name = name
+			}
+		}
+		return true
+	})
+}
+
+// maskStep is one invertible operation on each byte of a literal. Its key is
+// either a constant, or the index of the byte mixed with a constant.
+type maskStep struct {
+	op      token.Token // XOR, ADD, SUB, MUL, or SHL for a left rotation
+	key     byte
+	indexed bool
+}
+
+// maskSteps returns a random chain of one to three mask steps.
+func (g *generator) maskSteps() []maskStep {
+	ops := [...]token.Token{token.XOR, token.ADD, token.SUB, token.MUL, token.SHL}
+	steps := make([]maskStep, 1+g.rand.Intn(3))
+	for i := range steps {
+		step := maskStep{op: ops[g.rand.Intn(len(ops))], key: g.randByte()}
+		switch step.op {
+		case token.MUL:
+			step.key |= 1 // odd, so that it has an inverse
+		case token.SHL:
+			step.key = 1 + step.key%7
+		default:
+			step.indexed = g.rand.Intn(2) == 0
+		}
+		steps[i] = step
+	}
+	return steps
+}
+
+// apply masks the byte at index i.
+func (s maskStep) apply(i int, b byte) byte {
+	key := s.key
+	if s.indexed {
+		key ^= byte(i)
+	}
+	switch s.op {
+	case token.MUL:
+		return b * key
+	case token.SHL:
+		return b<<key | b>>(8-key)
+	default:
+		return evalOperator(s.op, b, key)
+	}
+}
+
+// mulInverse returns the multiplicative inverse of an odd byte, modulo 256.
+func mulInverse(x byte) byte {
+	inv := x // correct to three bits, as x*x == 1 mod 8
+	for i := 0; i < 2; i++ {
+		inv *= 2 - x*inv // each step doubles the correct bits
+	}
+	return inv
+}
+
+// unmask adds the statements undoing steps to the end of block, which must
+// leave the masked bytes in "data". The keys are computed by statements at
+// random places in block, so that they're part of the decoder's data flow.
+func (g *generator) unmask(block *ast.BlockStmt, steps []maskStep) {
+	// Reserve the names used by the obfuscator, as it doesn't use newName.
+	ast.Inspect(block, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			g.used[ident.Name] = true
+		}
+		return true
+	})
+
+	i, b := ast.NewIdent(g.newName()), ast.NewIdent(g.newName())
+	bin := func(x ast.Expr, op token.Token, y ast.Expr) ast.Expr {
+		return &ast.BinaryExpr{X: x, Op: op, Y: y}
+	}
+	var body []ast.Stmt
+	for n := len(steps) - 1; n >= 0; n-- {
+		step := steps[n]
+		var inverse ast.Expr
+		switch step.op {
+		case token.MUL:
+			inverse = bin(b, token.MUL, g.keyExpr(block, mulInverse(step.key)))
+		case token.SHL:
+			s := int(step.key)
+			inverse = bin(bin(b, token.SHR, ah.IntLit(s)), token.OR, bin(b, token.SHL, ah.IntLit(8-s)))
+		default:
+			key := g.keyExpr(block, step.key)
+			if step.indexed {
+				key = &ast.ParenExpr{X: bin(key, token.XOR, ah.CallExpr(ast.NewIdent("byte"), i))}
+			}
+			inverse = g.reverseOp(step.op, b, key)
+		}
+		body = append(body, &ast.AssignStmt{Lhs: []ast.Expr{b}, Tok: token.ASSIGN, Rhs: []ast.Expr{inverse}})
+	}
+
+	// for i := range data { b := data[i]; b = ...; data[i] = b }
+	data := ast.NewIdent("data")
+	body = append([]ast.Stmt{&ast.AssignStmt{
+		Lhs: []ast.Expr{b},
+		Tok: token.DEFINE,
+		Rhs: []ast.Expr{&ast.IndexExpr{X: data, Index: i}},
+	}}, body...)
+	body = append(body, &ast.AssignStmt{
+		Lhs: []ast.Expr{&ast.IndexExpr{X: data, Index: i}},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{b},
+	})
+	block.List = append(block.List, &ast.RangeStmt{
+		Key:  i,
+		Tok:  token.DEFINE,
+		X:    data,
+		Body: ah.BlockStmt(body...),
+	})
+}
+
+// keyExpr returns a byte expression without side effects which evaluates to
+// key. It may insert statements computing the key at a random place in block.
+func (g *generator) keyExpr(block *ast.BlockStmt, key byte) ast.Expr {
+	v := ast.NewIdent(g.newName())
+	assign := func(lhs ast.Expr, tok token.Token, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: tok, Rhs: []ast.Expr{rhs}}
+	}
+	byteLit := func(b byte) ast.Expr {
+		return ah.CallExpr(ast.NewIdent("byte"), ah.IntLit(int(b)))
+	}
+	var stmts []ast.Stmt
+	var expr ast.Expr
+	switch g.rand.Intn(4) {
+	case 0:
+		return byteLit(key)
+	case 1:
+		// v := byte(N); v = v<<s | v>>(8-s)
+		s := byte(1 + g.rand.Intn(7))
+		stmts = []ast.Stmt{
+			assign(v, token.DEFINE, byteLit(key>>s|key<<(8-s))),
+			assign(v, token.ASSIGN, &ast.BinaryExpr{
+				X:  &ast.BinaryExpr{X: v, Op: token.SHL, Y: ah.IntLit(int(s))},
+				Op: token.OR,
+				Y:  &ast.BinaryExpr{X: v, Op: token.SHR, Y: ah.IntLit(int(8 - s))},
+			}),
+		}
+		expr = v
+	case 2:
+		// v := uint32(N); for j := 0; j < M; j++ { v = v*K + C }; byte(v>>S) ^ D
+		i := ast.NewIdent(g.newName())
+		state, mul, add := g.rand.Uint32(), g.rand.Uint32()|1, g.rand.Uint32()
+		init, rounds, shift := state, 2+g.rand.Intn(6), 8*g.rand.Intn(4)
+		for j := 0; j < rounds; j++ {
+			state = state*mul + add
+		}
+		stmts = []ast.Stmt{
+			assign(v, token.DEFINE, ah.CallExpr(ast.NewIdent("uint32"), ah.UintLit(uint64(init)))),
+			&ast.ForStmt{
+				Init: assign(i, token.DEFINE, ah.IntLit(0)),
+				Cond: &ast.BinaryExpr{X: i, Op: token.LSS, Y: ah.IntLit(rounds)},
+				Post: &ast.IncDecStmt{X: i, Tok: token.INC},
+				Body: ah.BlockStmt(assign(v, token.ASSIGN, &ast.BinaryExpr{
+					X:  &ast.BinaryExpr{X: v, Op: token.MUL, Y: ah.UintLit(uint64(mul))},
+					Op: token.ADD,
+					Y:  ah.UintLit(uint64(add)),
+				})),
+			},
+		}
+		expr = &ast.ParenExpr{X: &ast.BinaryExpr{
+			X:  ah.CallExpr(ast.NewIdent("byte"), &ast.BinaryExpr{X: v, Op: token.SHR, Y: ah.IntLit(shift)}),
+			Op: token.XOR,
+			Y:  ah.IntLit(int(byte(state>>shift) ^ key)),
+		}}
+	default:
+		// var v [N]byte; v[I] ^= B; v[J] += C
+		n := 2 + g.rand.Intn(14)
+		i, j := g.rand.Intn(n), g.rand.Intn(n)
+		b := g.randByte()
+		c := key
+		if i == j {
+			c -= b
+		}
+		stmts = []ast.Stmt{
+			&ast.DeclStmt{Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names: []*ast.Ident{v},
+					Type:  &ast.ArrayType{Len: ah.IntLit(n), Elt: ast.NewIdent("byte")},
+				}},
+			}},
+			assign(&ast.IndexExpr{X: v, Index: ah.IntLit(i)}, token.XOR_ASSIGN, ah.IntLit(int(b))),
+			assign(&ast.IndexExpr{X: v, Index: ah.IntLit(j)}, token.ADD_ASSIGN, ah.IntLit(int(c))),
+		}
+		expr = &ast.IndexExpr{X: v, Index: ah.IntLit(j)}
+	}
+
+	pos := g.rand.Intn(len(block.List) + 1)
+	list := append([]ast.Stmt{}, block.List[:pos]...)
+	list = append(list, stmts...)
+	block.List = append(list, block.List[pos:]...)
+	return expr
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+	"strings"
+	"testing"
+)
+
+// decoderShape describes the code of a decoder, leaving out the names and the
+// literal values, which would differ between decoders anyway.
+func decoderShape(node ast.Node) string {
+	var sb strings.Builder
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case nil, *ast.Ident, *ast.BasicLit:
+		case *ast.BinaryExpr:
+			fmt.Fprintf(&sb, "%T%s ", node, node.Op)
+		case *ast.AssignStmt:
+			fmt.Fprintf(&sb, "%T%s ", node, node.Tok)
+		default:
+			fmt.Fprintf(&sb, "%T ", node)
+		}
+		return true
+	})
+	return sb.String()
+}
+
+func TestDecodersDiffer(t *testing.T) {
+	t.Parallel()
+	obfuscators := []obfuscator{simple{}, swap{}, split{}, shuffle{}, seed{}, chunked{}, chacha{}}
+	rand := mathrand.New(mathrand.NewSource(1))
+	for _, obfuscator := range obfuscators {
+		obfuscator := obfuscator
+		var shapes []string
+		for i := 0; i < 2; i++ {
+			call := obfuscateString(rand, obfuscator, "the same literal")
+
+			var sb strings.Builder
+			sb.WriteString("package p\n\nvar _ = ")
+			if err := printer.Fprint(&sb, token.NewFileSet(), call); err != nil {
+				t.Fatal(err)
+			}
+			if err := typecheck(sb.String()); err != nil {
+				t.Fatalf("%T decoder doesn't typecheck: %v\n%s", obfuscator, err, sb.String())
+			}
+			shapes = append(shapes, decoderShape(call))
+		}
+		if shapes[0] == shapes[1] {
+			t.Errorf("%T gave two decoders with the same code:\n%s", obfuscator, shapes[0])
+		}
+	}
+}
+
+// typecheck reports whether the source of a package is valid.
+func typecheck(src string) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		return err
+	}
+	_, err = new(types.Config).Check("p", fset, []*ast.File{file}, nil)
+	return err
+}
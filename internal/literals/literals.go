@@ -6,19 +6,23 @@ package literals
 import (
 	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/token"
 	"go/types"
 	mathrand "math/rand"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/tools/go/ast/astutil"
 	ah "mvdan.cc/garble/internal/asthelper"
 )
 
-// maxSizeBytes is the limit, in bytes, of the size of string-like literals
-// which we will obfuscate. This is important, because otherwise garble can take
-// a very long time to obfuscate huge code-generated literals, such as those
-// corresponding to large assets.
+// DefaultMaxSize is the default limit, in bytes, of the size of string-like
+// literals which we will obfuscate. Literals larger than a few KiB are
+// obfuscated in chunks, which takes linear time, but there is still a limit as
+// huge code-generated literals, such as those corresponding to large assets,
+// would slow down the build and bloat the binary.
 //
 // Note that this is the size of the literal in source code. For example, "\xab"
 // counts as four bytes.
@@ -26,128 +30,218 @@ import (
 // If someone truly wants to obfuscate those, they should do that when they
 // generate the code, not at build time. Plus, with Go 1.16 that technique
 // should largely stop being used.
-const maxSizeBytes = 2 << 10 // KiB
+const DefaultMaxSize = 64 << 10 // KiB
 
-func randObfuscator() obfuscator {
-	randPos := mathrand.Intn(len(obfuscators))
-	return obfuscators[randPos]
-}
+// Level selects how strongly literals are obfuscated, trading off the cost of
+// decoding them at run time. The zero value is LevelBalanced.
+type Level int
 
-// Obfuscate replace literals with obfuscated lambda functions
-func Obfuscate(files []*ast.File, info *types.Info, fset *token.FileSet, ignoreObj map[types.Object]bool) []*ast.File {
-	pre := func(cursor *astutil.Cursor) bool {
-		switch x := cursor.Node().(type) {
-		case *ast.GenDecl:
-			if x.Tok != token.CONST {
-				return true
-			}
-			for _, spec := range x.Specs {
-				spec, ok := spec.(*ast.ValueSpec)
-				if !ok {
-					return false
-				}
+const (
+	// LevelBalanced picks between all the simple obfuscators, avoiding the
+	// slower ones for large literals.
+	LevelBalanced Level = iota
 
-				for _, name := range spec.Names {
-					obj := info.ObjectOf(name)
+	// LevelFast only uses the obfuscators with the cheapest decoders.
+	LevelFast
 
-					basic, ok := obj.Type().(*types.Basic)
-					if !ok {
-						// skip the block if it contains non basic types
-						return false
-					}
+	// LevelStrong encrypts literals with a stream cipher.
+	LevelStrong
+)
 
-					if basic.Info()&types.IsUntyped != 0 {
-						// skip the block if it contains untyped constants
-						return false
-					}
+var levelNames = [...]string{
+	LevelBalanced: "balanced",
+	LevelFast:     "fast",
+	LevelStrong:   "strong",
+}
 
-					// The object cannot be obfuscated, e.g. a value that needs to be constant
-					if ignoreObj[obj] {
-						return false
-					}
-				}
-			}
+func (l Level) String() string { return levelNames[l] }
 
-			x.Tok = token.VAR
-			// constants are not possible if we want to obfuscate literals, therefore
-			// move all constant blocks which only contain strings to variables
+// ParseLevel parses a level name such as "fast".
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if s == name {
+			return Level(level), nil
 		}
-		return true
 	}
+	return 0, fmt.Errorf("unknown literals level %q", s)
+}
 
-	post := func(cursor *astutil.Cursor) bool {
-		switch x := cursor.Node().(type) {
-		case *ast.CompositeLit:
-			byteType := types.Universe.Lookup("byte").Type()
-
-			if len(x.Elts) == 0 {
-				return true
-			}
-
-			switch y := info.TypeOf(x.Type).(type) {
-			case *types.Array:
-				if y.Elem() != byteType {
-					return true
-				}
-				if y.Len() > maxSizeBytes {
-					return true
-				}
+// weightedObfuscator is an obfuscator which a level picks with the given
+// weight, for literals of up to maxSize bytes. The size limit is there because
+// the decoders of some obfuscators grow or slow down with each byte. Each level
+// has at least one obfuscator without a limit, which is given as zero.
+type weightedObfuscator struct {
+	obfuscator obfuscator
+	weight     int
+	maxSize    int
+}
 
-				data := make([]byte, y.Len())
+func (w weightedObfuscator) fits(size int) bool {
+	return w.maxSize == 0 || size <= w.maxSize
+}
 
-				for i, el := range x.Elts {
-					lit, ok := el.(*ast.BasicLit)
-					if !ok {
-						return true
-					}
+var levelObfuscators = [...][]weightedObfuscator{
+	LevelFast: {
+		{simple{}, 3, 2 << 10},
+		{swap{}, 2, 2 << 10},
+		{shuffle{}, 1, 32},
+		{chunked{}, 1, 0},
+	},
+	LevelBalanced: {
+		{simple{}, 2, 2 << 10},
+		{swap{}, 2, 2 << 10},
+		{split{}, 1, 256},
+		{shuffle{}, 2, 512},
+		{seed{}, 1, 256},
+		{chunked{}, 1, 0},
+	},
+	LevelStrong: {
+		{chacha{}, 1, 0},
+	},
+}
 
-					value, err := strconv.Atoi(lit.Value)
-					if err != nil {
-						return true
-					}
+// randObfuscator picks an obfuscator for a literal of the given size.
+func randObfuscator(rand *mathrand.Rand, level Level, size int) obfuscator {
+	total := 0
+	for _, w := range levelObfuscators[level] {
+		if w.fits(size) {
+			total += w.weight
+		}
+	}
+	n := rand.Intn(total)
+	for _, w := range levelObfuscators[level] {
+		if !w.fits(size) {
+			continue
+		}
+		if n < w.weight {
+			return w.obfuscator
+		}
+		n -= w.weight
+	}
+	panic("unreachable")
+}
 
-					data[i] = byte(value)
-				}
-				cursor.Replace(obfuscateByteArray(data, y.Len()))
+// Stats records what Obfuscate did with the literals it found.
+type Stats struct {
+	// Obfuscated counts the obfuscated literals by obfuscator name.
+	Obfuscated map[string]int
 
-			case *types.Slice:
-				if y.Elem() != byteType {
-					return true
-				}
-				if len(x.Elts) > maxSizeBytes {
-					return true
-				}
+	// TooLarge lists the positions of the literals left as-is, as they
+	// were larger than the maximum size.
+	TooLarge []token.Pos
+}
 
-				data := make([]byte, 0, len(x.Elts))
+func (s *Stats) recordObfuscated(obf obfuscator) {
+	if s == nil {
+		return
+	}
+	if s.Obfuscated == nil {
+		s.Obfuscated = make(map[string]int)
+	}
+	s.Obfuscated[strings.TrimPrefix(fmt.Sprintf("%T", obf), "literals.")]++
+}
 
-				for _, el := range x.Elts {
-					lit, ok := el.(*ast.BasicLit)
-					if !ok {
-						return true
-					}
+func (s *Stats) recordTooLarge(pos token.Pos) {
+	if s != nil {
+		s.TooLarge = append(s.TooLarge, pos)
+	}
+}
 
-					value, err := strconv.Atoi(lit.Value)
-					if err != nil {
-						return true
+// Obfuscate replace literals with obfuscated lambda functions, as selected by
+// level. With a cache mode other than CacheNone, each string and number is
+// decoded only once. Literals larger than maxSize bytes are left as-is. If
+// stats is not nil, it is filled with what was done.
+//
+// Each file is obfuscated with its own source of randomness in rands, so that
+// changes to one file don't alter how the others are obfuscated.
+func Obfuscate(files []*ast.File, rands []*mathrand.Rand, info *types.Info, fset *token.FileSet, ignoreObj map[types.Object]string, level Level, cacheMode Cache, maxSize int, stats *Stats) []*ast.File {
+	safeConsts := stringConsts(files, info, ignoreObj)
+	jumped := jumpedConsts(files, info)
+	cache := newLiteralCache(files, cacheMode)
+
+	var rand *mathrand.Rand // for the current file
+	pre := func(cursor *astutil.Cursor) bool {
+		switch x := cursor.Node().(type) {
+		case *ast.DeclStmt:
+			// Local constants; see the GenDecl case below.
+			decl := x.Decl.(*ast.GenDecl)
+			if decl.Tok != token.CONST {
+				return true
+			}
+			if jumped[x] {
+				return false
+			}
+			if constBlockToVar(decl, info, ignoreObj) {
+				return true
+			}
+			if varDecl := constsToVars(rand, decl, info, safeConsts, level, cache, maxSize, stats); varDecl != nil {
+				cursor.InsertAfter(&ast.DeclStmt{Decl: varDecl})
+			}
+			return false
+		case *ast.GenDecl:
+			if x.Tok != token.CONST {
+				return true
+			}
+			if !constBlockToVar(x, info, ignoreObj) {
+				// Even if the whole block can't be a var block, we
+				// can still move some string constants out.
+				if _, ok := cursor.Parent().(*ast.File); ok {
+					if varDecl := constsToVars(rand, x, info, safeConsts, level, cache, maxSize, stats); varDecl != nil {
+						cursor.InsertAfter(varDecl)
 					}
-
-					data = append(data, byte(value))
 				}
-				cursor.Replace(obfuscateByteSlice(data))
+				return false
+			}
 
+			x.Tok = token.VAR
+			// constants are not possible if we want to obfuscate literals, therefore
+			// move all constant blocks which only contain strings to variables
+		case *ast.CompositeLit:
+			// Handled before the elements, as they would otherwise be
+			// obfuscated one by one, e.g. in the "Value" position.
+			return !obfuscateCompositeLit(rand, cursor, info, level, maxSize, stats)
+		case *ast.CallExpr:
+			// []byte("...") conversions.
+			if len(x.Args) != 1 || !info.Types[x.Fun].IsType() {
+				return true
+			}
+			slice, ok := info.TypeOf(x.Fun).(*types.Slice)
+			if !ok || !types.Identical(slice.Elem(), types.Typ[types.Byte]) {
+				return true
+			}
+			lit, ok := x.Args[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
 			}
+			if len(lit.Value) > maxSize {
+				stats.recordTooLarge(lit.Pos())
+				return false
+			}
+			value := constant.StringVal(info.Types[lit].Value)
+			if value == "" {
+				return true
+			}
+			obfuscator := randObfuscator(rand, level, len(value))
+			cursor.Replace(obfuscateByteSlice(rand, obfuscator, []byte(value)))
+			stats.recordObfuscated(obfuscator)
+			return false
+		}
+		return true
+	}
 
+	post := func(cursor *astutil.Cursor) bool {
+		switch x := cursor.Node().(type) {
 		case *ast.BasicLit:
-			switch cursor.Name() {
-			case "Values", "Rhs", "Value", "Args", "X", "Y", "Results":
-			default:
+			if !obfuscatablePosition(cursor) {
 				return true // we don't want to obfuscate imports etc.
 			}
 
 			if x.Kind != token.STRING {
+				obfuscateNumberLit(rand, cursor, info, level, cache, stats)
 				return true
 			}
-			if len(x.Value) > maxSizeBytes {
+			if len(x.Value) > maxSize {
+				stats.recordTooLarge(x.Pos())
 				return true
 			}
 			typeInfo := info.TypeOf(x)
@@ -163,38 +257,217 @@ func Obfuscate(files []*ast.File, info *types.Info, fset *token.FileSet, ignoreO
 				return true
 			}
 
-			cursor.Replace(obfuscateString(value))
+			cursor.Replace(cache.use(rand, "string", value, func() ast.Expr {
+				obfuscator := randObfuscator(rand, level, len(value))
+				stats.recordObfuscated(obfuscator)
+				return obfuscateString(rand, obfuscator, value)
+			}))
+
+		case *ast.UnaryExpr:
+			// Negative numbers like -5 are unary expressions.
+			if _, ok := x.X.(*ast.BasicLit); !ok {
+				return true
+			}
+			if obfuscatablePosition(cursor) {
+				obfuscateNumberLit(rand, cursor, info, level, cache, stats)
+			}
 		}
 
 		return true
 	}
 
 	for i := range files {
+		rand = rands[i]
 		files[i] = astutil.Apply(files[i], pre, post).(*ast.File)
 	}
+	cache.addDecls(files)
 	return files
 }
 
-func obfuscateString(data string) *ast.CallExpr {
-	obfuscator := randObfuscator()
-	block := obfuscator.obfuscate([]byte(data))
+// ObfuscateData returns an expression for a string, or a byte slice if
+// asString is false, holding data obfuscated as selected by level. It is meant
+// for values which don't come from literals, such as embedded files. All
+// randomness comes from rand.
+//
+// If data is larger than maxSize bytes, nil is returned, so that the caller
+// can protect it in a cheaper way.
+func ObfuscateData(rand *mathrand.Rand, data []byte, asString bool, level Level, maxSize int, stats *Stats) ast.Expr {
+	if len(data) > maxSize {
+		return nil
+	}
+	obfuscator := randObfuscator(rand, level, len(data))
+	stats.recordObfuscated(obfuscator)
+	if asString {
+		return obfuscateString(rand, obfuscator, string(data))
+	}
+	return obfuscateByteSlice(rand, obfuscator, data)
+}
+
+// obfuscatablePosition reports whether the literal at the cursor may be
+// replaced with a function call. For example, import paths must stay as-is,
+// as must array lengths and struct tags, which are read via reflection.
+func obfuscatablePosition(cursor *astutil.Cursor) bool {
+	switch cursor.Name() {
+	case "Values", "Rhs", "Value", "Args", "X", "Y", "Results":
+		return true
+	case "List":
+		// Cases in expression switches don't need to be constant.
+		_, ok := cursor.Parent().(*ast.CaseClause)
+		return ok
+	}
+	return false
+}
+
+// obfuscateCompositeLit replaces the slice or array composite literal at the
+// cursor if it only contains constant bytes or runes. It reports whether the
+// literal was replaced.
+func obfuscateCompositeLit(rand *mathrand.Rand, cursor *astutil.Cursor, info *types.Info, level Level, maxSize int, stats *Stats) bool {
+	lit := cursor.Node().(*ast.CompositeLit)
+	if len(lit.Elts) == 0 || lit.Type == nil {
+		// Elided types might stand for &T{...}, which we can't replace.
+		return false
+	}
+	if unary, ok := cursor.Parent().(*ast.UnaryExpr); ok && unary.Op == token.AND {
+		return false // we can't take the address of a call
+	}
+
+	var elem types.Type
+	length := int64(-1) // a slice
+	switch typ := info.TypeOf(lit).(type) {
+	case *types.Array:
+		elem, length = typ.Elem(), typ.Len()
+	case *types.Slice:
+		elem = typ.Elem()
+	default:
+		return false
+	}
+	isByte := types.Identical(elem, types.Typ[types.Byte])
+	isRune := types.Identical(elem, types.Typ[types.Rune])
+	if !isByte && !isRune {
+		return false
+	}
+
+	values, ok := constElems(lit, info, maxSize)
+	if !ok {
+		return false
+	}
+	if len(values) > maxSize || length > int64(maxSize) {
+		stats.recordTooLarge(lit.Pos())
+		return false
+	}
+
+	size := len(values)
+	if int(length) > size {
+		size = int(length)
+	}
+	obfuscator := randObfuscator(rand, level, size)
+	switch {
+	case isByte && length >= 0:
+		data := make([]byte, length)
+		for i, v := range values {
+			data[i] = byte(v)
+		}
+		cursor.Replace(obfuscateByteArray(rand, obfuscator, data, length))
+	case isByte:
+		data := make([]byte, len(values))
+		for i, v := range values {
+			data[i] = byte(v)
+		}
+		cursor.Replace(obfuscateByteSlice(rand, obfuscator, data))
+	default:
+		runes := make([]rune, len(values))
+		for i, v := range values {
+			// Invalid runes wouldn't survive the conversion to a string.
+			if !utf8.ValidRune(rune(v)) {
+				return false
+			}
+			runes[i] = rune(v)
+		}
+		cursor.Replace(obfuscateRunes(rand, obfuscator, runes, length))
+	}
+	stats.recordObfuscated(obfuscator)
+	return true
+}
 
-	block.List = append(block.List, ah.ReturnStmt(ah.CallExpr(ast.NewIdent("string"), ast.NewIdent("data"))))
+// constElems returns the integer values of the elements of a slice or array
+// composite literal, taking keys into account. It returns false if any of the
+// keys or elements isn't constant, or if a key is larger than maxSize.
+func constElems(lit *ast.CompositeLit, info *types.Info, maxSize int) ([]int64, bool) {
+	var values []int64
+	index := int64(0)
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			key := info.Types[kv.Key].Value
+			if key == nil {
+				return nil, false
+			}
+			if index, ok = constant.Int64Val(key); !ok {
+				return nil, false
+			}
+			elt = kv.Value
+		}
+		value := info.Types[elt].Value
+		if value == nil || index > int64(maxSize) {
+			return nil, false
+		}
+		v, ok := constant.Int64Val(value)
+		if !ok {
+			return nil, false
+		}
+		for int64(len(values)) <= index {
+			values = append(values, 0)
+		}
+		values[index] = v
+		index++
+	}
+	return values, true
+}
 
-	return ah.LambdaCall(ast.NewIdent("string"), block)
+func obfuscateString(rand *mathrand.Rand, obfuscator obfuscator, data string) *ast.CallExpr {
+	return decoderCall(rand, obfuscator, []byte(data), ast.NewIdent("string"),
+		ah.ReturnStmt(ah.CallExpr(ast.NewIdent("string"), ast.NewIdent("data"))),
+	)
 }
 
-func obfuscateByteSlice(data []byte) *ast.CallExpr {
-	obfuscator := randObfuscator()
-	block := obfuscator.obfuscate(data)
-	block.List = append(block.List, ah.ReturnStmt(ast.NewIdent("data")))
-	return ah.LambdaCall(&ast.ArrayType{Elt: ast.NewIdent("byte")}, block)
+func obfuscateByteSlice(rand *mathrand.Rand, obfuscator obfuscator, data []byte) *ast.CallExpr {
+	return decoderCall(rand, obfuscator, data, &ast.ArrayType{Elt: ast.NewIdent("byte")},
+		ah.ReturnStmt(ast.NewIdent("data")),
+	)
 }
 
-func obfuscateByteArray(data []byte, length int64) *ast.CallExpr {
-	obfuscator := randObfuscator()
-	block := obfuscator.obfuscate(data)
+// obfuscateRunes returns an expression for a rune slice, or a rune array if
+// length isn't negative, obtained from an obfuscated string.
+func obfuscateRunes(rand *mathrand.Rand, obfuscator obfuscator, runes []rune, length int64) *ast.CallExpr {
+	str := obfuscateString(rand, obfuscator, string(runes))
+	runeSlice := ah.CallExpr(&ast.ArrayType{Elt: ast.NewIdent("rune")}, str)
+	if length < 0 {
+		return runeSlice
+	}
 
+	// func() [N]rune { var newdata [N]rune; copy(newdata[:], []rune(...)); return newdata }()
+	arrayType := &ast.ArrayType{
+		Len: ah.IntLit(int(length)),
+		Elt: ast.NewIdent("rune"),
+	}
+	return ah.LambdaCall(arrayType, ah.BlockStmt(
+		&ast.DeclStmt{
+			Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names: []*ast.Ident{ast.NewIdent("newdata")},
+					Type:  arrayType,
+				}},
+			},
+		},
+		ah.ExprStmt(ah.CallExpr(ast.NewIdent("copy"),
+			&ast.SliceExpr{X: ast.NewIdent("newdata")},
+			runeSlice,
+		)),
+		ah.ReturnStmt(ast.NewIdent("newdata")),
+	))
+}
+
+func obfuscateByteArray(rand *mathrand.Rand, obfuscator obfuscator, data []byte, length int64) *ast.CallExpr {
 	arrayType := &ast.ArrayType{
 		Len: ah.IntLit(int(length)),
 		Elt: ast.NewIdent("byte"),
@@ -225,13 +498,12 @@ func obfuscateByteArray(data []byte, length int64) *ast.CallExpr {
 		ah.ReturnStmt(ast.NewIdent("newdata")),
 	}
 
-	block.List = append(block.List, sliceToArray...)
-
-	return ah.LambdaCall(arrayType, block)
+	return decoderCall(rand, obfuscator, data, arrayType, sliceToArray...)
 }
 
-// RecordUsedAsConstants records identifieres used in constant expressions.
-func RecordUsedAsConstants(node ast.Node, info *types.Info, ignoreObj map[types.Object]bool) {
+// RecordUsedAsConstants records identifieres used in constant expressions,
+// along with the reason why they cannot be obfuscated.
+func RecordUsedAsConstants(node ast.Node, info *types.Info, ignoreObj map[types.Object]string) {
 	visit := func(node ast.Node) bool {
 		ident, ok := node.(*ast.Ident)
 		if !ok {
@@ -239,7 +511,7 @@ func RecordUsedAsConstants(node ast.Node, info *types.Info, ignoreObj map[types.
 		}
 
 		obj := info.ObjectOf(ident)
-		ignoreObj[obj] = true
+		ignoreObj[obj] = "used in a constant expression"
 
 		return true
 	}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package literals
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"math"
+	mathrand "math/rand"
+
+	"golang.org/x/tools/go/ast/astutil"
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// numberSize returns the number of bytes we use to encode an integer of the
+// given basic type, and the unsigned type of the same size. Note that int, uint
+// and uintptr are always encoded as 64 bits, as the result is converted to the
+// right size at run time.
+func numberSize(basic *types.Basic) (int, string) {
+	switch basic.Kind() {
+	case types.Int8, types.Uint8:
+		return 1, "byte"
+	case types.Int16, types.Uint16:
+		return 2, "uint16"
+	case types.Int32, types.Uint32:
+		return 4, "uint32"
+	case types.Int64, types.Uint64, types.Int, types.Uint, types.Uintptr:
+		return 8, "uint64"
+	}
+	return 0, ""
+}
+
+// obfuscateNumber returns an expression of the given basic type which
+// evaluates to value, or nil if the value can't be obfuscated.
+//
+// Integers are encoded as little endian bytes which are obfuscated like any
+// other byte slice. Floats are split into an integer mantissa, which is
+// obfuscated, and a power of two.
+func obfuscateNumber(rand *mathrand.Rand, obfuscator obfuscator, basic *types.Basic, value constant.Value) ast.Expr {
+	switch {
+	case basic.Info()&types.IsInteger != 0:
+		var bits uint64
+		if v, exact := constant.Int64Val(value); exact {
+			bits = uint64(v)
+		} else if v, exact := constant.Uint64Val(value); exact {
+			bits = v
+		} else {
+			return nil
+		}
+		return obfuscateInteger(rand, obfuscator, basic, bits)
+	case basic.Kind() == types.Float32, basic.Kind() == types.Float64:
+		f, _ := constant.Float64Val(value)
+		// minExp is the exponent of the smallest subnormal number;
+		// smaller powers of two can't be written as a literal.
+		mantBits, minExp := 53, -1074
+		if basic.Kind() == types.Float32 {
+			f = float64(float32(f))
+			mantBits, minExp = 24, -149
+		}
+		frac, exp := math.Frexp(f)
+		if frac == 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil
+		}
+		mant := int64(math.Ldexp(frac, mantBits))
+		exp -= mantBits
+		if exp < minExp || math.Ldexp(float64(mant), exp) != f {
+			return nil // e.g. most subnormal numbers
+		}
+		var pow ast.Expr = ah.Float64Lit(math.Ldexp(1, exp))
+		if basic.Kind() == types.Float32 {
+			pow = ah.Float32Lit(float32(math.Ldexp(1, exp)))
+		}
+		return &ast.BinaryExpr{
+			X:  ah.CallExpr(ast.NewIdent(basic.Name()), obfuscateInteger(rand, obfuscator, types.Typ[types.Int64], uint64(mant))),
+			Op: token.MUL,
+			Y:  pow,
+		}
+	}
+	return nil
+}
+
+// obfuscateInteger returns an expression of the given integer type which
+// evaluates to bits, truncated to the type's size.
+func obfuscateInteger(rand *mathrand.Rand, obfuscator obfuscator, basic *types.Basic, bits uint64) ast.Expr {
+	size, unsigned := numberSize(basic)
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(bits >> (8 * i))
+	}
+
+	// uintN(data[0]) | uintN(data[1])<<8 | ...
+	var combined ast.Expr
+	for i := 0; i < size; i++ {
+		var part ast.Expr = ah.IndexExpr("data", ah.IntLit(i))
+		if size > 1 {
+			part = ah.CallExpr(ast.NewIdent(unsigned), part)
+		}
+		if i > 0 {
+			part = &ast.BinaryExpr{X: part, Op: token.SHL, Y: ah.IntLit(8 * i)}
+			part = &ast.BinaryExpr{X: combined, Op: token.OR, Y: part}
+		}
+		combined = part
+	}
+	if basic.Name() != unsigned {
+		combined = ah.CallExpr(ast.NewIdent(basic.Name()), combined)
+	}
+	return decoderCall(rand, obfuscator, data, ast.NewIdent(basic.Name()), ah.ReturnStmt(combined))
+}
+
+// obfuscateNumberLit replaces the numeric literal at the cursor, if it has a
+// typed integer or float value which doesn't need to be constant.
+//
+// The values 0 and 1 are left alone, as they are everywhere and give nothing
+// away.
+func obfuscateNumberLit(rand *mathrand.Rand, cursor *astutil.Cursor, info *types.Info, level Level, cache *literalCache, stats *Stats) {
+	tv := info.Types[cursor.Node().(ast.Expr)]
+	basic, ok := tv.Type.(*types.Basic)
+	if !ok || tv.Value == nil || basic.Info()&types.IsUntyped != 0 {
+		return
+	}
+	// If the parent is a constant expression, such as 2*3 or uint16(5),
+	// it may be needed as a constant; we also can't tell if changing
+	// part of it would alter its value.
+	if parent, ok := cursor.Parent().(ast.Expr); ok && info.Types[parent].Value != nil {
+		return
+	}
+	switch tv.Value.ExactString() {
+	case "0", "1":
+		return
+	}
+	expr := cache.use(rand, basic.Name(), tv.Value.ExactString(), func() ast.Expr {
+		obfuscator := randObfuscator(rand, level, 8) // numbers take at most eight bytes
+		expr := obfuscateNumber(rand, obfuscator, basic, tv.Value)
+		if expr != nil {
+			stats.recordObfuscated(obfuscator)
+		}
+		return expr
+	})
+	if expr != nil {
+		cursor.Replace(expr)
+	}
+}
@@ -7,13 +7,13 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
-	mathrand "math/rand"
 	"os"
 )
 
-// obfuscator takes a byte slice and converts it to a ast.BlockStmt
+// obfuscator takes a byte slice and converts it to a ast.BlockStmt. The
+// generator is used to randomize the shape of the resulting decoder.
 type obfuscator interface {
-	obfuscate(data []byte) *ast.BlockStmt
+	obfuscate(gen *generator, data []byte) *ast.BlockStmt
 }
 
 var (
@@ -28,33 +28,30 @@ var (
 	envGarbleSeed = os.Getenv("GARBLE_SEED")
 )
 
-// If math/rand.Seed() is not called, the generator behaves as if seeded by rand.Seed(1),
-// so the generator is deterministic.
-
-// genRandBytes return a random []byte with the length of size.
-func genRandBytes(buffer []byte) {
-	if _, err := mathrand.Read(buffer); err != nil {
+// randBytes fills buffer with random bytes.
+func (g *generator) randBytes(buffer []byte) {
+	if _, err := g.rand.Read(buffer); err != nil {
 		panic(fmt.Sprintf("couldn't generate random key:  %v", err))
 	}
 }
 
-func genRandByte() byte {
+func (g *generator) randByte() byte {
 	bytes := make([]byte, 1)
-	genRandBytes(bytes)
+	g.randBytes(bytes)
 	return bytes[0]
 }
 
-func genRandIntSlice(max, count int) []int {
+func (g *generator) randIntSlice(max, count int) []int {
 	indexes := make([]int, count)
 	for i := 0; i < count; i++ {
-		indexes[i] = mathrand.Intn(max)
+		indexes[i] = g.rand.Intn(max)
 	}
 	return indexes
 }
 
-func randOperator() token.Token {
+func (g *generator) randOperator() token.Token {
 	operatorTokens := [...]token.Token{token.XOR, token.ADD, token.SUB}
-	return operatorTokens[mathrand.Intn(len(operatorTokens))]
+	return operatorTokens[g.rand.Intn(len(operatorTokens))]
 }
 
 func evalOperator(t token.Token, x, y byte) byte {
@@ -15,11 +15,11 @@ type seed struct{}
 // check that the obfuscator interface is implemented
 var _ obfuscator = seed{}
 
-func (seed) obfuscate(data []byte) *ast.BlockStmt {
-	seed := genRandByte()
+func (seed) obfuscate(gen *generator, data []byte) *ast.BlockStmt {
+	seed := gen.randByte()
 	originalSeed := seed
 
-	op := randOperator()
+	op := gen.randOperator()
 
 	var callExpr *ast.CallExpr
 	for i, b := range data {
@@ -97,7 +97,7 @@ func (seed) obfuscate(data []byte) *ast.BlockStmt {
 							Lhs: []ast.Expr{ast.NewIdent("data")},
 							Tok: token.ASSIGN,
 							Rhs: []ast.Expr{
-								ah.CallExpr(ast.NewIdent("append"), ast.NewIdent("data"), operatorToReversedBinaryExpr(op, ast.NewIdent("x"), ast.NewIdent("seed"))),
+								ah.CallExpr(ast.NewIdent("append"), ast.NewIdent("data"), gen.reverseOp(op, ast.NewIdent("x"), ast.NewIdent("seed"))),
 							},
 						},
 						&ast.AssignStmt{
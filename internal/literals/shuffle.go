@@ -6,7 +6,6 @@ package literals
 import (
 	"go/ast"
 	"go/token"
-	mathrand "math/rand"
 
 	ah "mvdan.cc/garble/internal/asthelper"
 )
@@ -16,21 +15,21 @@ type shuffle struct{}
 // check that the obfuscator interface is implemented
 var _ obfuscator = shuffle{}
 
-func (shuffle) obfuscate(data []byte) *ast.BlockStmt {
+func (shuffle) obfuscate(gen *generator, data []byte) *ast.BlockStmt {
 	key := make([]byte, len(data))
-	genRandBytes(key)
+	gen.randBytes(key)
 
 	fullData := make([]byte, len(data)+len(key))
 	operators := make([]token.Token, len(fullData))
 	for i := range operators {
-		operators[i] = randOperator()
+		operators[i] = gen.randOperator()
 	}
 
 	for i, b := range key {
 		fullData[i], fullData[i+len(data)] = evalOperator(operators[i], data[i], b), b
 	}
 
-	shuffledIdxs := mathrand.Perm(len(fullData))
+	shuffledIdxs := gen.rand.Perm(len(fullData))
 
 	shuffledFullData := make([]byte, len(fullData))
 	for i, b := range fullData {
@@ -39,7 +38,7 @@ func (shuffle) obfuscate(data []byte) *ast.BlockStmt {
 
 	args := []ast.Expr{ast.NewIdent("data")}
 	for i := range data {
-		args = append(args, operatorToReversedBinaryExpr(
+		args = append(args, gen.reverseOp(
 			operators[i],
 			ah.IndexExpr("fullData", ah.IntLit(shuffledIdxs[i])),
 			ah.IndexExpr("fullData", ah.IntLit(shuffledIdxs[len(data)+i])),
@@ -15,11 +15,11 @@ type simple struct{}
 // check that the obfuscator interface is implemented
 var _ obfuscator = simple{}
 
-func (simple) obfuscate(data []byte) *ast.BlockStmt {
+func (simple) obfuscate(gen *generator, data []byte) *ast.BlockStmt {
 	key := make([]byte, len(data))
-	genRandBytes(key)
+	gen.randBytes(key)
 
-	op := randOperator()
+	op := gen.randOperator()
 	for i, b := range key {
 		data[i] = evalOperator(op, data[i], b)
 	}
@@ -44,7 +44,7 @@ func (simple) obfuscate(data []byte) *ast.BlockStmt {
 				&ast.AssignStmt{
 					Lhs: []ast.Expr{ah.IndexExpr("data", ast.NewIdent("i"))},
 					Tok: token.ASSIGN,
-					Rhs: []ast.Expr{operatorToReversedBinaryExpr(op, ah.IndexExpr("data", ast.NewIdent("i")), ast.NewIdent("b"))},
+					Rhs: []ast.Expr{gen.reverseOp(op, ah.IndexExpr("data", ast.NewIdent("i")), ast.NewIdent("b"))},
 				},
 			}},
 		},
@@ -6,7 +6,7 @@ package main
 import (
 	"fmt"
 	"go/ast"
-	mathrand "math/rand"
+	"go/token"
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
@@ -111,7 +111,8 @@ func (tf *transformer) transformLineInfo(file *ast.File, name string) (detachedC
 	detachedComments = append(detachedComments, "", "//line "+prefix+":1")
 	file.Comments = nil
 
-	newLines := mathrand.Perm(len(file.Decls))
+	rand := newRand("lines", name)
+	newLines := rand.Perm(len(file.Decls))
 
 	funcCounter := 0
 	pre := func(cursor *astutil.Cursor) bool {
@@ -128,7 +129,7 @@ func (tf *transformer) transformLineInfo(file *ast.File, name string) (detachedC
 		}
 		newPos := fmt.Sprintf("%s%c.go:%d",
 			prefix,
-			nameCharset[mathrand.Intn(len(nameCharset))],
+			nameCharset[rand.Intn(len(nameCharset))],
 			PosMin+newLines[funcCounter],
 		)
 
@@ -138,5 +139,49 @@ func (tf *transformer) transformLineInfo(file *ast.File, name string) (detachedC
 		return true
 	}
 
-	return detachedComments, astutil.Apply(file, pre, nil).(*ast.File)
+	file = astutil.Apply(file, pre, nil).(*ast.File)
+	splitDirectiveSpecs(file)
+	return detachedComments, file
+}
+
+// splitDirectiveSpecs moves each variable in a parenthesized declaration which
+// has directives, such as //go:embed, to a declaration of its own. Since our
+// comments have no positions, the printer would misplace them otherwise.
+func splitDirectiveSpecs(file *ast.File) {
+	var decls []ast.Decl
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR || !gen.Lparen.IsValid() || gen.Doc != nil || !hasSpecDocs(gen) {
+			decls = append(decls, decl)
+			continue
+		}
+		var rest []ast.Spec
+		flush := func() {
+			if len(rest) > 0 {
+				decls = append(decls, &ast.GenDecl{Tok: token.VAR, Lparen: gen.Lparen, Specs: rest})
+				rest = nil
+			}
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ValueSpec)
+			if spec.Doc == nil {
+				rest = append(rest, spec)
+				continue
+			}
+			flush()
+			decls = append(decls, &ast.GenDecl{Doc: spec.Doc, Tok: token.VAR, Specs: []ast.Spec{spec}})
+			spec.Doc = nil
+		}
+		flush()
+	}
+	file.Decls = decls
+}
+
+func hasSpecDocs(decl *ast.GenDecl) bool {
+	for _, spec := range decl.Specs {
+		if spec.(*ast.ValueSpec).Doc != nil {
+			return true
+		}
+	}
+	return false
 }
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -29,6 +28,7 @@ import (
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,18 +47,135 @@ var (
 )
 
 var (
-	flagGarbleLiterals bool
-	flagGarbleTiny     bool
-	flagDebugDir       string
-	flagSeed           string
+	flagGarbleLiterals   bool
+	flagLiteralLevel     literals.Level
+	flagLiteralOverrides []literalOverride
+	flagLiteralCache     string
+	flagLiteralMaxSize   int
+	flagControlFlow      bool
+	flagOpaque           int
+	flagMBA              bool
+	flagIndirectCalls    bool
+	flagShuffleFields    bool
+	flagShuffleFiles     bool
+	flagMergePkgs        string
+	flagNaming           string
+	flagPrivateMethods   bool
+	flagGarbleTiny       bool
+	flagModInfo          bool
+	flagDebugDir         string
+	flagSeed             string
+	flagSBOM             string
+	flagSBOMHash         bool
+	flagReport           string
+
+	flagExplain bool // set by "garble explain"
 )
 
 func init() {
 	flagSet.Usage = usage
-	flagSet.BoolVar(&flagGarbleLiterals, "literals", false, "Obfuscate literals such as strings")
+	flagSet.Var(literalsFlag{}, "literals", "Obfuscate literals such as strings and numbers\nFor a level, provide -literals=fast|balanced|strong, with optional per-package\nlevels such as -literals=fast,example.com/secret/...=strong")
+	flagSet.StringVar(&flagLiteralCache, "literalcache", "", "Decode each obfuscated string and number only once, either at -literalcache=init\nor on first use with -literalcache=lazy, which needs the package to depend on sync")
+	flagSet.IntVar(&flagLiteralMaxSize, "literalmaxsize", literals.DefaultMaxSize, "Leave literals larger than this many bytes of source code as-is, with a warning")
+	flagSet.BoolVar(&flagControlFlow, "controlflow", false, "Flatten the control flow of functions into a loop over a state variable\nSingle functions can be flattened via a //garble:flatten directive")
+	flagSet.Var(opaqueFlag{}, "opaque", "Add branches on opaque predicates and junk code which never runs to functions\nFor a density other than 20% of statements, provide -opaque=N")
+	flagSet.BoolVar(&flagMBA, "mba", false, "Rewrite integer operations like + and ^ into mixed boolean-arithmetic expressions")
+	flagSet.BoolVar(&flagIndirectCalls, "indirectcalls", false, "Call unexported functions through tables of functions indexed by obfuscated values")
+	flagSet.BoolVar(&flagShuffleFields, "shufflefields", false, "Shuffle the fields of unexported struct types whose layout can't be observed")
+	flagSet.BoolVar(&flagShuffleFiles, "shufflefiles", false, "Merge, split, reorder and rename the files of each package")
+	flagSet.StringVar(&flagMergePkgs, "mergepkgs", "", "Merge the private packages matching comma-separated patterns into the main package,\ne.g. -mergepkgs=example.com/app/internal")
+	flagSet.StringVar(&flagNaming, "naming", "hash", "Choose how to rename identifiers: hash, short for the shortest names,\nwords for names made of words, or random for names without look-alike characters")
+	flagSet.BoolVar(&flagPrivateMethods, "privatemethods", false, "Obfuscate the exported methods which only interfaces in private packages need; requires -seed\nReflection via method names computed at run time, like net/rpc, can break")
 	flagSet.BoolVar(&flagGarbleTiny, "tiny", false, "Optimize for binary size, losing the ability to reverse the process")
+	flagSet.BoolVar(&flagModInfo, "modinfo", false, "Keep the versions of public modules in the build info, e.g. for vulnerability scanners")
 	flagSet.StringVar(&flagDebugDir, "debugdir", "", "Write the garbled source to a directory, e.g. -debugdir=out")
-	flagSet.StringVar(&flagSeed, "seed", "", "Provide a base64-encoded seed, e.g. -seed=o9WDTZ4CN4w\nFor a random seed, provide -seed=random")
+	flagSet.StringVar(&flagSeed, "seed", "", "Provide a base64-encoded seed, e.g. -seed=o9WDTZ4CN4w\nFor a random seed, provide -seed=random\nWithout a fixed seed, editing one file of a package changes the obfuscation of all of them")
+	flagSet.StringVar(&flagSBOM, "sbom", "", "Write an SPDX JSON bill of materials for the built modules, e.g. -sbom=out.spdx.json")
+	flagSet.BoolVar(&flagSBOMHash, "sbomhash", false, "List private modules in the -sbom output under their hashed names only")
+	flagSet.StringVar(&flagReport, "report", "", "Write a JSON report of how each private package was obfuscated, e.g. -report=report.json")
+}
+
+// literalsFlag implements -literals, a boolean flag which also accepts a
+// level such as -literals=strong. The level can be overridden for packages
+// matching a pattern, as in -literals=fast,example.com/secret/...=strong.
+type literalsFlag struct{}
+
+// literalOverride is a per-package level given to -literals. The pattern is
+// matched like GOPRIVATE.
+type literalOverride struct {
+	Pattern string
+	Level   literals.Level
+}
+
+func (literalsFlag) IsBoolFlag() bool { return true }
+
+func (literalsFlag) String() string {
+	if !flagGarbleLiterals {
+		return "false"
+	}
+	return formatLiterals(flagLiteralLevel, flagLiteralOverrides)
+}
+
+func (literalsFlag) Set(s string) error {
+	flagGarbleLiterals, flagLiteralLevel, flagLiteralOverrides = true, literals.LevelBalanced, nil
+	for _, field := range strings.Split(s, ",") {
+		if i := strings.LastIndexByte(field, '='); i >= 0 {
+			level, err := literals.ParseLevel(field[i+1:])
+			if err != nil {
+				return err
+			}
+			flagLiteralOverrides = append(flagLiteralOverrides, literalOverride{
+				Pattern: field[:i],
+				Level:   level,
+			})
+			continue
+		}
+		if level, err := literals.ParseLevel(field); err == nil {
+			flagLiteralLevel = level
+			continue
+		}
+		enabled, err := strconv.ParseBool(field)
+		if err != nil {
+			return fmt.Errorf("must be a boolean, a level such as %q, or a list of pattern=level", "strong")
+		}
+		flagGarbleLiterals = enabled
+	}
+	return nil
+}
+
+// formatLiterals formats a -literals level and its overrides like the flag
+// accepts them.
+func formatLiterals(level literals.Level, overrides []literalOverride) string {
+	fields := []string{level.String()}
+	for _, override := range overrides {
+		fields = append(fields, override.Pattern+"="+override.Level.String())
+	}
+	return strings.Join(fields, ",")
+}
+
+// literalLevel returns the -literals level for the package being compiled,
+// given its Go files. Main packages are compiled as "main", so we find their
+// import path via the directory of their files.
+func literalLevel(pkgPath string, paths []string) literals.Level {
+	if pkgPath == "main" {
+		dirs := make(map[string]bool)
+		for _, path := range paths {
+			dirs[filepath.Dir(path)] = true
+		}
+		for _, pkg := range cache.ListedPackages {
+			if pkg.Name == "main" && dirs[pkg.Dir] {
+				pkgPath = pkg.ImportPath
+				break
+			}
+		}
+	}
+	level := opts.LiteralLevel
+	for _, override := range opts.LiteralOverrides {
+		if module.MatchPrefixPatterns(override.Pattern, pkgPath) {
+			level = override.Level // the last match wins
+		}
+	}
+	return level
 }
 
 func usage() {
@@ -127,6 +244,10 @@ var (
 const (
 	// Note that these are capped at 16 bytes.
 	headerDebugSource = "garble/debugSrc"
+	headerExplain     = "garble/explain"
+	headerReport      = "garble/report"
+	headerNames       = "garble/names"
+	headerFiles       = "garble/files"
 )
 
 func garbledImport(path string) (*types.Package, error) {
@@ -264,6 +385,10 @@ func mainErr(args []string) error {
 		return nil
 	case "reverse":
 		return commandReverse(args)
+	case "audit":
+		return commandAudit(args)
+	case "explain":
+		return commandExplain(args)
 	case "build", "test", "list":
 		cmd, err := toolexecCmd(command, args)
 		if err != nil {
@@ -271,7 +396,18 @@ func mainErr(args []string) error {
 		}
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return cmd.Run()
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+		if flagSBOM != "" && command == "build" {
+			if err := writeSBOM(flagSBOM); err != nil {
+				return err
+			}
+		}
+		if flagReport != "" && command == "build" {
+			return writeReport(flagReport, args)
+		}
+		return nil
 	}
 
 	if !filepath.IsAbs(args[0]) {
@@ -363,6 +499,11 @@ func toolexecCmd(command string, args []string) (*exec.Cmd, error) {
 	if err := setListedPackages(args); err != nil {
 		return nil, err
 	}
+	if opts.PrivateMethods {
+		if err := setPrivateMethods(); err != nil {
+			return nil, err
+		}
+	}
 
 	sharedTempDir, err = saveShared()
 	if err != nil {
@@ -371,6 +512,13 @@ func toolexecCmd(command string, args []string) (*exec.Cmd, error) {
 	os.Setenv("GARBLE_SHARED", sharedTempDir)
 	defer os.Remove(sharedTempDir)
 
+	return goCmd(command, flags, args), nil
+}
+
+// goCmd returns a go command which runs the tools via garble, using the options
+// and shared data which toolexecCmd already set up. As such, it can be used
+// again after a build, such as to list the same export files.
+func goCmd(command string, flags, args []string) *exec.Cmd {
 	goArgs := []string{
 		command,
 		"-trimpath",
@@ -384,7 +532,7 @@ func toolexecCmd(command string, args []string) (*exec.Cmd, error) {
 	goArgs = append(goArgs, flags...)
 	goArgs = append(goArgs, args...)
 
-	return exec.Command("go", goArgs...), nil
+	return exec.Command("go", goArgs...)
 }
 
 var transformFuncs = map[string]func([]string) (args []string, post func() error, _ error){
@@ -401,19 +549,36 @@ func transformCompile(args []string) ([]string, func() error, error) {
 	flags = append(flags, "-dwarf=false")
 
 	curPkgPath = flagValue(flags, "-p")
-	if (curPkgPath == "runtime" && opts.Tiny) || curPkgPath == "runtime/internal/sys" {
+	patchingEmbed := curPkgPath == "embed" && opts.GarbleLiterals && privateEmbeds()
+	if (curPkgPath == "runtime" && opts.Tiny) || curPkgPath == "runtime/internal/sys" || patchingEmbed {
 		// Even though these packages aren't private, we will still process
-		// them later to remove build information and strip code from the
-		// runtime. However, we only want flags to work on private packages.
+		// them later to remove build information, strip code from the
+		// runtime, or decrypt embedded files. However, we only want flags to
+		// work on private packages.
 		opts.GarbleLiterals = false
+		opts.ControlFlow = false
+		opts.Opaque = 0
+		opts.MBA = false
+		opts.IndirectCalls = false
+		opts.ShuffleFields = false
+		opts.ShuffleFiles = false
 		opts.DebugDir = ""
 	} else if !isPrivate(curPkgPath) {
 		return append(flags, paths...), nil, nil
 	}
+	var extraPaths []string
 	for i, path := range paths {
 		if filepath.Base(path) == "_gomod_.go" {
-			// never include module info
+			// Never include the original module info. With -modinfo, we
+			// include a copy which only lists public modules.
 			paths = append(paths[:i], paths[i+1:]...)
+			if opts.ModInfo {
+				modInfoPath, err := publicModInfo(path)
+				if err != nil {
+					return nil, nil, err
+				}
+				extraPaths = append(extraPaths, modInfoPath)
+			}
 			break
 		}
 	}
@@ -440,21 +605,30 @@ func transformCompile(args []string) ([]string, func() error, error) {
 
 		files = append(files, file)
 	}
-
-	randSeed := opts.Seed
-	if len(randSeed) == 0 {
-		randSeed = curActionID
+	if opts.MergePkgs != "" && curPkgPath == "main" {
+		var importCfg string
+		if files, paths, importCfg, err = mergePackages(files, paths); err != nil {
+			return nil, nil, err
+		}
+		if importCfg != "" {
+			flags = flagSetValue(flags, "-importcfg", importCfg)
+			curImportCfg = importCfg
+		}
 	}
-	// log.Printf("seeding math/rand with %x\n", randSeed)
-	mathrand.Seed(int64(binary.BigEndian.Uint64(randSeed)))
 
 	tf := &transformer{
 		info: &types.Info{
 			Types: make(map[ast.Expr]types.TypeAndValue),
 			Defs:  make(map[*ast.Ident]types.Object),
 			Uses:  make(map[*ast.Ident]types.Object),
+
+			Implicits: make(map[ast.Node]types.Object),
 		},
 	}
+	if opts.Report {
+		tf.report = &packageReport{ImportPath: curPkgPath}
+		tf.renamed = make(map[types.Object]bool)
+	}
 
 	standardLibrary := false
 	// Note that flagValue only supports "-foo=true" bool flags, but the std
@@ -488,9 +662,69 @@ func transformCompile(args []string) ([]string, func() error, error) {
 
 	tf.recordReflectArgs(files)
 
+	if opts.ShuffleFields {
+		tf.shuffleFields(files, paths)
+	}
+	for i, file := range files {
+		tf.flattenControlFlow(file, filepath.Base(paths[i]))
+	}
+	if opts.Opaque > 0 {
+		for i, file := range files {
+			tf.addOpaquePredicates(files, file, filepath.Base(paths[i]))
+		}
+	}
+	if opts.MBA {
+		for i, file := range files {
+			tf.obfuscateArithmetic(file, filepath.Base(paths[i]))
+		}
+	}
+	if opts.IndirectCalls {
+		tf.indirectCalls(files, paths)
+	}
+
 	if opts.GarbleLiterals {
+		stats := &literals.Stats{}
+		level := literalLevel(curPkgPath, paths)
 		// TODO: use transformer here?
-		files = literals.Obfuscate(files, tf.info, fset, tf.ignoreObjects)
+		rands := make([]*mathrand.Rand, len(files))
+		for i, path := range paths {
+			rands[i] = newRand("literals", filepath.Base(path))
+		}
+		cacheMode := opts.LiteralCache
+		if cacheMode == literals.CacheLazy && !dependsOn(curPkgPath, "sync") {
+			// Importing sync would add a package to the build, or
+			// cause an import cycle.
+			cacheMode = literals.CacheInit
+		}
+		files = literals.Obfuscate(files, rands, tf.info, fset, tf.ignoreObjects, level, cacheMode, opts.LiteralMaxSize, stats)
+		if cacheMode != opts.LiteralCache && len(stats.Obfuscated) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: warning: -literalcache=lazy needs the package to depend on sync; literals are decoded at init instead\n", curPkgPath)
+		}
+		if _, ok := buildInfo.imports["sync"]; !ok && cacheMode == literals.CacheLazy && importsPath(files, "sync") {
+			// The literal cache added the import.
+			importCfg, err := extendImportCfg("sync")
+			if err != nil {
+				return nil, nil, err
+			}
+			flags = flagSetValue(flags, "-importcfg", importCfg)
+			curImportCfg = importCfg
+		}
+		if embedcfg := flagValue(flags, "-embedcfg"); embedcfg != "" {
+			newcfg, err := tf.transformEmbeds(files, embedcfg, level, stats)
+			if err != nil {
+				return nil, nil, err
+			}
+			if newcfg != "" {
+				flags = flagSetValue(flags, "-embedcfg", newcfg)
+			}
+		}
+		for _, pos := range stats.TooLarge {
+			fmt.Fprintf(os.Stderr, "%s: warning: literal larger than -literalmaxsize=%d was not obfuscated\n", fset.Position(pos), opts.LiteralMaxSize)
+		}
+		if tf.report != nil {
+			tf.report.LiteralsObfuscated = stats.Obfuscated
+			tf.report.LiteralsTooLarge = len(stats.TooLarge)
+		}
 	}
 
 	// Add our temporary dir to the beginning of -trimpath, so that we don't
@@ -500,6 +734,7 @@ func transformCompile(args []string) ([]string, func() error, error) {
 	// log.Println(flags)
 
 	detachedComments := make([][]string, len(files))
+	names := make([]string, len(files))
 
 	for i, file := range files {
 		name := filepath.Base(filepath.Clean(paths[i]))
@@ -507,7 +742,17 @@ func transformCompile(args []string) ([]string, func() error, error) {
 		comments, file := tf.transformLineInfo(file, name)
 		tf.handleDirectives(comments)
 
-		detachedComments[i], files[i] = comments, file
+		detachedComments[i], files[i], names[i] = comments, file, name
+	}
+	if opts.ShuffleFiles {
+		files, detachedComments, names = tf.shuffleFiles(files, detachedComments, names)
+	}
+	var collisions []string
+	if isPrivate(curPkgPath) {
+		if opts.Naming == "short" {
+			tf.setShortNames(files)
+		}
+		collisions = tf.avoidCollisions(files)
 	}
 
 	obfSrcArchive := &bytes.Buffer{}
@@ -517,15 +762,17 @@ func transformCompile(args []string) ([]string, func() error, error) {
 	obfSrcTarWriter := tar.NewWriter(obfSrcGzipWriter)
 	defer obfSrcTarWriter.Close()
 
-	// TODO: randomize the order and names of the files
 	newPaths := make([]string, 0, len(files))
 	for i, file := range files {
-		origName := filepath.Base(filepath.Clean(paths[i]))
+		origName := names[i]
 		name := origName
 		switch {
 		case curPkgPath == "runtime":
 			// strip unneeded runtime code
-			stripRuntime(origName, file)
+			stripped := stripRuntime(origName, file)
+			if tf.report != nil {
+				tf.report.RuntimeStripped = append(tf.report.RuntimeStripped, stripped...)
+			}
 		case curPkgPath == "runtime/internal/sys":
 			// The first declaration in zversion.go contains the Go
 			// version as follows. Replace it here, since the
@@ -540,13 +787,25 @@ func transformCompile(args []string) ([]string, func() error, error) {
 			spec := file.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec)
 			lit := spec.Values[0].(*ast.BasicLit)
 			lit.Value = "`unknown`"
+		case patchingEmbed:
+			// Don't touch the source in any other way either.
+			if origName != "embed.go" {
+				break
+			}
+			patchPath, err := patchEmbed(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			extraPaths = append(extraPaths, patchPath)
 		case strings.HasPrefix(origName, "_cgo_"):
 			// Cgo generated code requires a prefix. Also, don't
 			// garble it, since it's just generated code and it gets
-			// messy.
-			name = "_cgo_" + name
+			// messy. With -shufflefiles, the prefix is already there.
+			if !opts.ShuffleFiles {
+				name = "_cgo_" + name
+			}
 		default:
-			file = tf.transformGo(file)
+			file = tf.transformGo(file, name)
 
 			// Uncomment for some quick debugging. Do not delete.
 			// fmt.Fprintf(os.Stderr, "\n-- %s/%s --\n", curPkgPath, origName)
@@ -589,6 +848,29 @@ func transformCompile(args []string) ([]string, func() error, error) {
 
 		newPaths = append(newPaths, tempFile.Name())
 	}
+	if len(collisions) > 0 {
+		// Shown next to the source with -debugdir.
+		data := strings.Join(collisions, "\n") + "\n"
+		if err := obfSrcTarWriter.WriteHeader(&tar.Header{
+			Name:    "garble_collisions.txt",
+			Mode:    0o644,
+			ModTime: time.Now(),
+			Size:    int64(len(data)),
+		}); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.WriteString(obfSrcTarWriter, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	newPaths = append(newPaths, extraPaths...)
+	var reportData []byte
+	if tf.report != nil {
+		tf.countNames()
+		if reportData, err = json.Marshal(tf.report); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// After the compilation succeeds, add our headers to the object file.
 	objPath := flagValue(flags, "-o")
@@ -611,6 +893,45 @@ func transformCompile(args []string) ([]string, func() error, error) {
 				Data: obfSrcArchive.Bytes(),
 			}},
 		)
+		if reportData != nil {
+			pkg.ArchiveMembers = append(pkg.ArchiveMembers,
+				goobj2.ArchiveMember{ArchiveHeader: goobj2.ArchiveHeader{
+					Name: headerReport,
+					Size: int64(len(reportData)),
+					Data: reportData,
+				}},
+			)
+		}
+		if len(nameTables[curPkgPath]) > 0 {
+			data := nameTableData()
+			pkg.ArchiveMembers = append(pkg.ArchiveMembers,
+				goobj2.ArchiveMember{ArchiveHeader: goobj2.ArchiveHeader{
+					Name: headerNames,
+					Size: int64(len(data)),
+					Data: data,
+				}},
+			)
+		}
+		if len(tf.fileNames) > 0 {
+			data := tf.fileNamesData()
+			pkg.ArchiveMembers = append(pkg.ArchiveMembers,
+				goobj2.ArchiveMember{ArchiveHeader: goobj2.ArchiveHeader{
+					Name: headerFiles,
+					Size: int64(len(data)),
+					Data: data,
+				}},
+			)
+		}
+		if opts.Explain {
+			data := tf.explanationData()
+			pkg.ArchiveMembers = append(pkg.ArchiveMembers,
+				goobj2.ArchiveMember{ArchiveHeader: goobj2.ArchiveHeader{
+					Name: headerExplain,
+					Size: int64(len(data)),
+					Data: data,
+				}},
+			)
+		}
 
 		return pkg.Write(objPath)
 	}
@@ -638,7 +959,7 @@ func (tf *transformer) handleDirectives(comments []string) {
 		// The local name must not be obfuscated.
 		obj := tf.pkg.Scope().Lookup(localName)
 		if obj != nil {
-			tf.ignoreObjects[obj] = true
+			tf.ignoreObjects[obj] = "used in a go:linkname directive"
 		}
 
 		// If the new name is of the form "pkgpath.Name", and
@@ -666,7 +987,7 @@ func (tf *transformer) handleDirectives(comments []string) {
 
 		// The name exists and was obfuscated; replace the
 		// comment with the obfuscated name.
-		obfName := hashWith(listedPkg.actionID, name)
+		obfName := obfuscatedName(listedPkg.actionID, pkg, name)
 		fields[2] = pkg + "." + obfName
 		comments[i] = strings.Join(fields, " ")
 	}
@@ -839,7 +1160,7 @@ func fillBuildInfo(flags []string) error {
 //
 // The resulting map mainly contains named types and their field declarations.
 func (tf *transformer) recordReflectArgs(files []*ast.File) {
-	tf.ignoreObjects = make(map[types.Object]bool)
+	tf.ignoreObjects = make(map[types.Object]string)
 
 	visitReflectArg := func(node ast.Node) bool {
 		expr, _ := node.(ast.Expr) // info.TypeOf(nil) will just return nil
@@ -852,7 +1173,7 @@ func (tf *transformer) recordReflectArgs(files []*ast.File) {
 		if obj == nil || obj.Pkg() != tf.pkg {
 			return true
 		}
-		recordStruct(named, tf.ignoreObjects)
+		recordStruct(named, tf.ignoreObjects, "used via reflection")
 
 		return true
 	}
@@ -896,8 +1217,9 @@ type transformer struct {
 	pkg  *types.Package
 	info *types.Info
 
-	// ignoreObjects records all the objects we cannot obfuscate. An object
-	// is any named entity, such as a declared variable or type.
+	// ignoreObjects records all the objects we cannot obfuscate, along with
+	// the reason why. An object is any named entity, such as a declared
+	// variable or type.
 	//
 	// So far, this map records:
 	//
@@ -906,13 +1228,56 @@ type transformer struct {
 	//  * Identifiers used in go:linkname directives; see handleDirectives.
 	//  * Types or variables from external packages which were not
 	//    obfuscated, for caching reasons; see transformGo.
-	ignoreObjects map[types.Object]bool
+	ignoreObjects map[types.Object]string
+
+	// explanations records why other objects were not obfuscated, such as
+	// exported methods. It is only filled when opts.Explain is set; see
+	// explain.go.
+	explanations map[types.Object]string
+
+	// report is filled for -report; see report.go. renamed records the
+	// objects declared in this package which were obfuscated.
+	report  *packageReport
+	renamed map[types.Object]bool
+
+	// globalNames records the names of the package-level declarations we
+	// added, such as the variables for -opaque; see globalName.
+	globalNames map[string]bool
+
+	// fileNames maps the new file names from -shufflefiles to the original
+	// ones, to be stored in the object file for "garble reverse".
+	fileNames map[string]string
+}
+
+// globalName returns a name for a new package-level declaration, starting with
+// base, which must not be declared in the package nor shadowed in any of its
+// files.
+func (tf *transformer) globalName(files []*ast.File, base string) string {
+	used := make(map[string]bool)
+	for _, file := range files {
+		ast.Inspect(file, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok {
+				used[ident.Name] = true
+			}
+			return true
+		})
+	}
+	name := base
+	for i := 2; used[name] || tf.pkg.Scope().Lookup(name) != nil || tf.globalNames[name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	if tf.globalNames == nil {
+		tf.globalNames = make(map[string]bool)
+	}
+	tf.globalNames[name] = true
+	return name
 }
 
-// transformGo garbles the provided Go syntax node.
-func (tf *transformer) transformGo(file *ast.File) *ast.File {
+// transformGo garbles the provided Go syntax node, from the file with the given
+// name.
+func (tf *transformer) transformGo(file *ast.File, name string) *ast.File {
 	// Shuffle top level declarations
-	mathrand.Shuffle(len(file.Decls), func(i, j int) {
+	newRand("decls", name).Shuffle(len(file.Decls), func(i, j int) {
 		decl1 := file.Decls[i]
 		decl2 := file.Decls[j]
 
@@ -942,7 +1307,11 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 			return true // unnamed remains unnamed
 		}
 		if strings.HasPrefix(node.Name, "_C") || strings.Contains(node.Name, "_cgo") {
-			return true // don't mess with cgo-generated code
+			// don't mess with cgo-generated code
+			if obj := tf.info.ObjectOf(node); obj != nil {
+				tf.explain(obj, "cgo name")
+			}
+			return true
 		}
 		obj := tf.info.ObjectOf(node)
 		if obj == nil {
@@ -966,11 +1335,12 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 		if pkg.Name() == "main" && obj.Exported() && obj.Parent() == pkg.Scope() {
 			// TODO: only do this when -buildmode is plugin? what
 			// about other -buildmode options?
-			return true // could be a Go plugin API
+			tf.explain(obj, "exported by a main package, which could be a plugin API")
+			return true
 		}
 
 		// We don't want to obfuscate this object.
-		if tf.ignoreObjects[obj] {
+		if _, ok := tf.ignoreObjects[obj]; ok {
 			return true
 		}
 
@@ -1010,7 +1380,7 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 				}
 				if garbledPkg, _ := garbledImport(path); garbledPkg != nil {
 					if garbledPkg.Scope().Lookup(named.Obj().Name()) != nil {
-						recordStruct(named, tf.ignoreObjects)
+						recordStruct(named, tf.ignoreObjects, "not obfuscated in its defining package")
 						return true
 					}
 				}
@@ -1030,7 +1400,7 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 				}
 				if garbledPkg, _ := garbledImport(path); garbledPkg != nil {
 					if garbledPkg.Scope().Lookup(x.Name()) != nil {
-						recordStruct(named, tf.ignoreObjects)
+						recordStruct(named, tf.ignoreObjects, "not obfuscated in its defining package")
 						return true
 					}
 				}
@@ -1038,16 +1408,29 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 		case *types.Func:
 			sign := obj.Type().(*types.Signature)
 			if obj.Exported() && sign.Recv() != nil {
+				// Unless only private interfaces need it, along
+				// with all the other methods with its name.
+				if newName, ok := cache.PrivateMethods[node.Name]; ok {
+					node.Name = newName
+					if tf.renamed != nil && obj.Pkg() == tf.pkg {
+						tf.renamed[obj] = true
+					}
+					return true
+				}
+				tf.explain(obj, "exported method, which might implement an interface")
 				return true // might implement an interface
 			}
 			if implementedOutsideGo(x) {
+				tf.explain(obj, "implemented outside Go, such as in assembly")
 				return true // give up in this case
 			}
 			switch node.Name {
 			case "main", "init", "TestMain":
+				tf.explain(obj, "special function name")
 				return true // don't break them
 			}
 			if strings.HasPrefix(node.Name, "Test") && isTestSignature(sign) {
+				tf.explain(obj, "test function")
 				return true // don't break tests
 			}
 		default:
@@ -1070,45 +1453,9 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 		// add an extra archive header to record all direct and indirect
 		// importcfg data, like we do with private name maps.
 		if _, e := buildInfo.imports[path]; !e && path != curPkgPath {
-			goArgs := []string{
-				"list",
-				"-json",
-				"-export",
-				"-trimpath",
-				"-toolexec=" + cache.ExecPath,
-			}
-			goArgs = append(goArgs, cache.BuildFlags...)
-			goArgs = append(goArgs, path)
-
-			cmd := exec.Command("go", goArgs...)
-			cmd.Dir = opts.GarbleDir
-			out, err := cmd.Output()
-			if err != nil {
-				if err := err.(*exec.ExitError); err != nil {
-					panic(fmt.Sprintf("%v: %s", err, err.Stderr))
-				}
-				panic(err)
-			}
-			var pkg listedPackage
-			if err := json.Unmarshal(out, &pkg); err != nil {
+			if err := addGarbledImports(path); err != nil {
 				panic(err) // shouldn't happen
 			}
-			buildID, err := buildidOf(pkg.Export)
-			if err != nil {
-				panic(err) // shouldn't happen
-			}
-			// Adding it to buildInfo.imports allows us to reuse the
-			// "if" branch below. Plus, if this edge case triggers
-			// multiple times in a single package compile, we can
-			// call "go list" once and cache its result.
-			if pkg.ImportPath != path {
-				panic(fmt.Sprintf("unexpected path: %q vs %q", pkg.ImportPath, path))
-			}
-			buildInfo.imports[path] = importedPkg{
-				packagefile: pkg.Export,
-				actionID:    decodeHash(splitActionID(buildID)),
-			}
-			// log.Printf("fetched indirect dependency %q from: %s", path, pkg.Export)
 		}
 
 		actionID := curActionID
@@ -1125,6 +1472,7 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 			// If the object returned from the garbled package's scope has a different type as the object
 			// we're searching for, they are most likely two separate objects with the same name, so ok to garble
 			if o := garbledPkg.Scope().Lookup(obj.Name()); o != nil && reflect.TypeOf(o) == reflect.TypeOf(obj) {
+				tf.explain(obj, "not obfuscated in its defining package")
 				return true
 			}
 			actionID = id
@@ -1133,7 +1481,10 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 		origName := node.Name
 		_ = origName // used for debug prints below
 
-		node.Name = hashWith(actionID, node.Name)
+		node.Name = obfuscatedName(actionID, path, node.Name)
+		if tf.renamed != nil && obj.Pkg() == tf.pkg {
+			tf.renamed[obj] = true
+		}
 		// log.Printf("%q hashed with %x to %q", origName, actionID, node.Name)
 		return true
 	}
@@ -1143,14 +1494,14 @@ func (tf *transformer) transformGo(file *ast.File) *ast.File {
 // recordStruct adds the given named type to the map, plus all of its fields if
 // it is a struct. This function is mainly used for types used via reflection,
 // so we want to record their members too.
-func recordStruct(named *types.Named, m map[types.Object]bool) {
-	m[named.Obj()] = true
+func recordStruct(named *types.Named, m map[types.Object]string, reason string) {
+	m[named.Obj()] = reason
 	strct, ok := named.Underlying().(*types.Struct)
 	if !ok {
 		return
 	}
 	for i := 0; i < strct.NumFields(); i++ {
-		m[strct.Field(i)] = true
+		m[strct.Field(i)] = reason
 	}
 }
 
@@ -1180,6 +1531,112 @@ func namedType(t types.Type) *types.Named {
 	}
 }
 
+// extendImportCfg writes a copy of the current -importcfg which also covers the
+// given packages, and returns its path. The packages must not be in the current
+// -importcfg.
+func extendImportCfg(paths ...string) (string, error) {
+	if err := addGarbledImports(paths...); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(curImportCfg)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.Write(data)
+	for _, path := range paths {
+		fmt.Fprintf(&sb, "\npackagefile %s=%s", path, buildInfo.imports[path].packagefile)
+	}
+	sb.WriteString("\n")
+	tempFile, err := ioutil.TempFile(sharedTempDir, "importcfg.*")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+	if _, err := tempFile.WriteString(sb.String()); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+// dependsOn reports whether the listed package pkgPath imports path, directly
+// or indirectly.
+func dependsOn(pkgPath, path string) bool {
+	pkg := cache.ListedPackages[pkgPath]
+	if pkg == nil {
+		return false
+	}
+	for _, dep := range pkg.Deps {
+		if dep == path {
+			return true
+		}
+	}
+	return false
+}
+
+// importsPath reports whether any of the files imports path.
+func importsPath(files []*ast.File, path string) bool {
+	for _, file := range files {
+		for _, spec := range file.Imports {
+			if p, err := strconv.Unquote(spec.Path.Value); err == nil && p == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addGarbledImports adds packages which aren't in the current -importcfg to
+// buildInfo.imports, via an extra "go list -toolexec" call to retrieve the
+// export paths of their obfuscated builds.
+func addGarbledImports(paths ...string) error {
+	goArgs := []string{
+		"list",
+		"-json",
+		"-export",
+		"-trimpath",
+		"-toolexec=" + cache.ExecPath,
+	}
+	goArgs = append(goArgs, cache.BuildFlags...)
+	goArgs = append(goArgs, paths...)
+
+	cmd := exec.Command("go", goArgs...)
+	cmd.Dir = opts.GarbleDir
+	out, err := cmd.Output()
+	if err != nil {
+		if err, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%v: %s", err, err.Stderr)
+		}
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var pkg listedPackage
+		if err := dec.Decode(&pkg); err != nil {
+			return err
+		}
+		if pkg.Export == "" {
+			continue // e.g. unsafe
+		}
+		buildID, err := buildidOf(pkg.Export)
+		if err != nil {
+			return err
+		}
+		// Adding it to buildInfo.imports allows us to reuse it if this
+		// happens multiple times in a single package compile, so that
+		// we call "go list" once per package.
+		buildInfo.imports[pkg.ImportPath] = importedPkg{
+			packagefile: pkg.Export,
+			actionID:    decodeHash(splitActionID(buildID)),
+		}
+		// log.Printf("fetched indirect dependency %q from: %s", pkg.ImportPath, pkg.Export)
+	}
+	return nil
+}
+
 // isTestSignature returns true if the signature matches "func _(*testing.T)".
 func isTestSignature(sign *types.Signature) bool {
 	if sign.Recv() != nil {
@@ -1243,8 +1700,8 @@ func transformLink(args []string) ([]string, func() error, error) {
 			pkgPath = buildInfo.firstImport
 		}
 		id := buildInfo.imports[pkgPath].actionID
-		newName := hashWith(id, name)
-		garbledPkg := hashWith(id, pkg)
+		newName := obfuscatedName(id, pkg, name)
+		garbledPkg := hashImport(pkg, nil)
 		flags = append(flags, fmt.Sprintf("-X=%s.%s=%s", garbledPkg, newName, str))
 	})
 
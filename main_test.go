@@ -14,6 +14,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -30,7 +31,14 @@ var proxyURL string
 
 func TestMain(m *testing.M) {
 	os.Exit(testscript.RunMain(garbleMain{m}, map[string]func() int{
-		"garble": main1,
+		"garble": func() int {
+			// Scripts can shorten the hashed names, to force
+			// collisions.
+			if n, err := strconv.Atoi(os.Getenv("GARBLE_TEST_NAMELENGTH")); err == nil && n >= 0 {
+				nameLength = n
+			}
+			return main1()
+		},
 	}))
 }
 
@@ -194,9 +202,18 @@ func generateLiterals(ts *testscript.TestScript, neg bool, args []string) {
 			Rhs: []ast.Expr{literal},
 		})
 	}
+	// Add 3 large literals, which are obfuscated in chunks.
+	for i := 0; i < 3; i++ {
+		literal := generateStringLit(8 << 10)
+		statements = append(statements, &ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("_")},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{literal},
+		})
+	}
 	// Add 5 huge literals, to make sure we don't try to obfuscate them.
-	// 5 * 128KiB is large enough that it would take a very, very long time
-	// to obfuscate those literals with our simple code.
+	// 5 * 128KiB is over the default -literalmaxsize, and it would still
+	// take a long time to obfuscate and build those literals.
 	for i := 0; i < 5; i++ {
 		literal := generateStringLit(128 << 10)
 		statements = append(statements, &ast.AssignStmt{
@@ -336,3 +353,41 @@ func TestFlagValue(t *testing.T) {
 		})
 	}
 }
+
+func TestUniqueNames(t *testing.T) {
+	t.Parallel()
+	// Like a hash, but which only keeps the first letter of the name, so
+	// that names starting with the same letter collide.
+	newName := func(name string, attempt int) string {
+		return "z" + name[:1] + strings.Repeat("x", attempt)
+	}
+	tests := []struct {
+		name     string
+		names    []string
+		reserved []string
+		want     map[string]string
+	}{
+		{"NoCollisions", []string{"foo", "bar"}, nil,
+			map[string]string{"foo": "zf", "bar": "zb"}},
+		{"Collision", []string{"foo", "fizz", "bar"}, nil,
+			map[string]string{"fizz": "zf", "foo": "zfx", "bar": "zb"}},
+		{"CollisionOrder", []string{"bar", "foo", "fizz"}, nil,
+			map[string]string{"fizz": "zf", "foo": "zfx", "bar": "zb"}},
+		{"Reserved", []string{"foo", "fizz"}, []string{"zf"},
+			map[string]string{"fizz": "zfx", "foo": "zfxx"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			reserved := make(map[string]bool)
+			for _, name := range test.reserved {
+				reserved[name] = true
+			}
+			got, _ := uniqueNames(test.names, reserved, newName)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("uniqueNames(%q) mismatch (-want +got):\n%s", test.names, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// mbaOps are the operators rewritten by -mba, including in assignments such as
+// x += y.
+var mbaOps = map[token.Token]token.Token{
+	token.ADD: token.ADD,
+	token.SUB: token.SUB,
+	token.XOR: token.XOR,
+	token.AND: token.AND,
+	token.OR:  token.OR,
+
+	token.ADD_ASSIGN: token.ADD,
+	token.SUB_ASSIGN: token.SUB,
+	token.XOR_ASSIGN: token.XOR,
+	token.AND_ASSIGN: token.AND,
+	token.OR_ASSIGN:  token.OR,
+}
+
+// obfuscateArithmetic rewrites the integer operations + - ^ & | in a file into
+// equivalent mixed boolean-arithmetic expressions, such as (x^y) + 2*(x&y) for
+// x + y. The identities hold for any integer type, even when it overflows.
+//
+// Only operations on typed integers are rewritten, and only if both operands
+// are simple enough to be evaluated more than once, such as variables and
+// literals. Constant expressions are left alone, since they might need to stay
+// constant. So is pointer arithmetic, meaning uintptr values and anything
+// converted to unsafe.Pointer.
+func (tf *transformer) obfuscateArithmetic(file *ast.File, name string) {
+	if strings.HasPrefix(name, "_cgo_") {
+		return
+	}
+	m := &mbaRewriter{tf: tf, rand: newRand("mba", name)}
+	pre := func(cursor *astutil.Cursor) bool {
+		switch node := cursor.Node().(type) {
+		case *ast.GenDecl:
+			return node.Tok != token.CONST
+		case *ast.ArrayType:
+			// The length must be constant; the element type has no
+			// expressions we could rewrite.
+			return false
+		case *ast.CallExpr:
+			// Leave pointer arithmetic such as
+			// unsafe.Pointer(uintptr(p) + off) as-is.
+			if tv := tf.info.Types[node.Fun]; tv.IsType() {
+				if basic, ok := tv.Type.Underlying().(*types.Basic); ok && basic.Kind() == types.UnsafePointer {
+					return false
+				}
+			}
+		case *ast.BinaryExpr:
+			op, ok := mbaOps[node.Op]
+			if !ok || tf.info.Types[node].Value != nil || !m.operands(node.X, node.Y) {
+				return true
+			}
+			cursor.Replace(paren(m.rewrite(op, node.X, node.Y)))
+			return false
+		case *ast.AssignStmt:
+			op, ok := mbaOps[node.Tok]
+			if !ok || !m.operands(node.Lhs[0], node.Rhs[0]) {
+				return true
+			}
+			lhs := node.Lhs[0]
+			node.Tok = token.ASSIGN
+			node.Rhs[0] = m.rewrite(op, m.copy(lhs), node.Rhs[0])
+			return false
+		}
+		return true
+	}
+	astutil.Apply(file, pre, nil)
+}
+
+type mbaRewriter struct {
+	tf   *transformer
+	rand *mathrand.Rand
+}
+
+// operands reports whether the operands of an operation are typed integers
+// which can be evaluated more than once.
+func (m *mbaRewriter) operands(x, y ast.Expr) bool {
+	for _, expr := range []ast.Expr{x, y} {
+		typ := m.tf.info.TypeOf(expr)
+		if typ == nil {
+			return false
+		}
+		basic, ok := typ.Underlying().(*types.Basic)
+		if !ok || basic.Info()&types.IsInteger == 0 || basic.Info()&types.IsUntyped != 0 {
+			return false
+		}
+		if basic.Kind() == types.Uintptr {
+			// Likely pointer arithmetic, which must stay recognizable
+			// for checkptr and the garbage collector.
+			return false
+		}
+		if !m.simple(expr) {
+			return false
+		}
+	}
+	return true
+}
+
+// simple reports whether an expression has no side effects and is cheap to
+// evaluate, such as a variable, a struct field, a literal, or a conversion of
+// one of those.
+func (m *mbaRewriter) simple(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return m.tf.info.ObjectOf(expr) != nil && expr.Name != "_"
+	case *ast.ParenExpr:
+		return m.simple(expr.X)
+	case *ast.SelectorExpr:
+		// Fields of variables, and names from other packages.
+		if _, ok := expr.X.(*ast.Ident); !ok {
+			return false
+		}
+		if sel := m.tf.info.Selections[expr]; sel != nil && sel.Kind() != types.FieldVal {
+			return false
+		}
+		return m.simple(expr.X)
+	case *ast.CallExpr:
+		// Conversions such as uint32(b).
+		if len(expr.Args) != 1 || !m.tf.info.Types[expr.Fun].IsType() {
+			return false
+		}
+		return m.simple(expr.Fun) && m.simple(expr.Args[0])
+	}
+	return false
+}
+
+// copy returns a copy of a simple expression, keeping its type information so
+// that later steps such as renaming still apply to it.
+func (m *mbaRewriter) copy(expr ast.Expr) ast.Expr {
+	info := m.tf.info
+	var dup ast.Expr
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		dup = &ast.BasicLit{Kind: expr.Kind, Value: expr.Value}
+	case *ast.Ident:
+		ident := ast.NewIdent(expr.Name)
+		info.Uses[ident] = info.ObjectOf(expr)
+		dup = ident
+	case *ast.ParenExpr:
+		dup = paren(m.copy(expr.X))
+	case *ast.SelectorExpr:
+		sel := &ast.SelectorExpr{X: m.copy(expr.X), Sel: m.copy(expr.Sel).(*ast.Ident)}
+		if s := info.Selections[expr]; s != nil {
+			info.Selections[sel] = s
+		}
+		dup = sel
+	case *ast.CallExpr:
+		dup = &ast.CallExpr{Fun: m.copy(expr.Fun), Args: []ast.Expr{m.copy(expr.Args[0])}}
+	}
+	if tv, ok := info.Types[expr]; ok {
+		info.Types[dup] = tv
+	}
+	return dup
+}
+
+// rewrite returns a mixed boolean-arithmetic expression for x op y, which uses
+// the original operands once and copies of them elsewhere.
+func (m *mbaRewriter) rewrite(op token.Token, x, y ast.Expr) ast.Expr {
+	x2, y2 := m.copy(x), m.copy(y)
+	twice := func(expr ast.Expr) ast.Expr {
+		return binaryExpr(ah.IntLit(2), token.MUL, paren(expr))
+	}
+	alt := m.rand.Intn(2) == 0
+	switch op {
+	case token.ADD:
+		if alt {
+			// x + y == (x|y) + (x&y)
+			return binaryExpr(paren(binaryExpr(x, token.OR, y)), token.ADD, paren(binaryExpr(x2, token.AND, y2)))
+		}
+		// x + y == (x^y) + 2*(x&y)
+		return binaryExpr(paren(binaryExpr(x, token.XOR, y)), token.ADD, twice(binaryExpr(x2, token.AND, y2)))
+	case token.SUB:
+		if alt {
+			// x - y == (x&^y) - (y&^x)
+			return binaryExpr(paren(binaryExpr(x, token.AND_NOT, y)), token.SUB, paren(binaryExpr(y2, token.AND_NOT, x2)))
+		}
+		// x - y == (x^y) - 2*(y&^x)
+		return binaryExpr(paren(binaryExpr(x, token.XOR, y)), token.SUB, twice(binaryExpr(y2, token.AND_NOT, x2)))
+	case token.XOR:
+		if alt {
+			// x ^ y == (x|y) &^ (x&y)
+			return binaryExpr(paren(binaryExpr(x, token.OR, y)), token.AND_NOT, paren(binaryExpr(x2, token.AND, y2)))
+		}
+		// x ^ y == (x|y) - (x&y)
+		return binaryExpr(paren(binaryExpr(x, token.OR, y)), token.SUB, paren(binaryExpr(x2, token.AND, y2)))
+	case token.AND:
+		if alt {
+			// x & y == (x|y) ^ (x^y)
+			return binaryExpr(paren(binaryExpr(x, token.OR, y)), token.XOR, paren(binaryExpr(x2, token.XOR, y2)))
+		}
+		// x & y == (x+y) - (x|y)
+		return binaryExpr(paren(binaryExpr(x, token.ADD, y)), token.SUB, paren(binaryExpr(x2, token.OR, y2)))
+	default: // token.OR
+		if alt {
+			// x | y == (x^y) + (x&y)
+			return binaryExpr(paren(binaryExpr(x, token.XOR, y)), token.ADD, paren(binaryExpr(x2, token.AND, y2)))
+		}
+		// x | y == (x+y) - (x&y)
+		return binaryExpr(paren(binaryExpr(x, token.ADD, y)), token.SUB, paren(binaryExpr(x2, token.AND, y2)))
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/ast/astutil"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// mergedPackages returns the packages which -mergepkgs merges into the main
+// package in dir, each after its dependencies.
+//
+// Only private non-main packages can be merged, and only if all the packages
+// which import them are merged too, as otherwise the binary would end up with
+// two copies of them. Packages with cgo, assembly, or embedded files aren't
+// supported, since their extra files are tied to the package.
+func mergedPackages(dir string) ([]*listedPackage, error) {
+	var mainPkg *listedPackage
+	for _, pkg := range cache.ListedPackages {
+		if pkg.Name == "main" && pkg.Dir == dir {
+			mainPkg = pkg
+			break
+		}
+	}
+	if mainPkg == nil {
+		return nil, nil
+	}
+
+	merged := make(map[string]bool)
+	var list []*listedPackage
+	for _, path := range mainPkg.Deps {
+		pkg := cache.ListedPackages[path]
+		if pkg == nil || pkg.Name == "main" || !isPrivate(path) || !module.MatchPrefixPatterns(opts.MergePkgs, path) {
+			continue
+		}
+		switch {
+		case len(pkg.CgoFiles) > 0:
+			return nil, fmt.Errorf("cannot merge %s: it uses cgo", path)
+		case len(pkg.SFiles) > 0:
+			return nil, fmt.Errorf("cannot merge %s: it has assembly files", path)
+		case len(pkg.EmbedPatterns) > 0:
+			return nil, fmt.Errorf("cannot merge %s: it embeds files", path)
+		}
+		merged[path] = true
+		list = append(list, pkg)
+	}
+	for _, path := range mainPkg.Deps {
+		if merged[path] {
+			continue
+		}
+		for _, imported := range cache.ListedPackages[path].Imports {
+			if merged[imported] {
+				return nil, fmt.Errorf("cannot merge %s: it is imported by %s, which isn't merged", imported, path)
+			}
+		}
+	}
+
+	// A package always has more dependencies than those it imports.
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].Deps) != len(list[j].Deps) {
+			return len(list[i].Deps) < len(list[j].Deps)
+		}
+		return list[i].ImportPath < list[j].ImportPath
+	})
+	return list, nil
+}
+
+// mergePackages implements -mergepkgs, adding the files of the merged packages
+// to the files of the main package being compiled. The files are given first,
+// so that the merged packages are still initialized before the main package.
+//
+// The top-level names of the merged packages are renamed to be unique and
+// unexported, since the main package keeps its exported names, and the uses of
+// the merged packages in all files are rewritten to use the new names. The
+// returned -importcfg also covers the packages imported by the merged ones.
+func mergePackages(files []*ast.File, paths []string) (_ []*ast.File, _ []string, importCfg string, _ error) {
+	dir, err := filepath.Abs(filepath.Dir(paths[0]))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	merged, err := mergedPackages(dir)
+	if err != nil || len(merged) == 0 {
+		return files, paths, "", err
+	}
+
+	// Type-check each package on its own, as that's how their uses and
+	// definitions are resolved.
+	type mergeUnit struct {
+		files []*ast.File
+		info  *types.Info
+	}
+	var units []mergeUnit
+	var allFiles []*ast.File
+	var allPaths []string
+	isMerged := make(map[string]bool)
+	for _, pkg := range merged {
+		isMerged[pkg.ImportPath] = true
+		var pkgFiles []*ast.File
+		for _, name := range pkg.GoFiles {
+			file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, parser.ParseComments)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			for _, group := range file.Comments {
+				for _, comment := range group.List {
+					if strings.HasPrefix(comment.Text, "//go:linkname") {
+						return nil, nil, "", fmt.Errorf("cannot merge %s: it uses go:linkname", pkg.ImportPath)
+					}
+				}
+			}
+			pkgFiles = append(pkgFiles, file)
+			// Merged files may share names with the main package's.
+			allPaths = append(allPaths, filepath.Join(pkg.Dir, hashWith(curActionID, pkg.ImportPath)+"_"+name))
+		}
+		units = append(units, mergeUnit{files: pkgFiles})
+		allFiles = append(allFiles, pkgFiles...)
+	}
+	units = append(units, mergeUnit{files: files})
+	allFiles = append(allFiles, files...)
+	allPaths = append(allPaths, paths...)
+	for i, unit := range units {
+		path := curPkgPath
+		if i < len(merged) {
+			path = merged[i].ImportPath
+		}
+		units[i].info = &types.Info{
+			Defs: make(map[*ast.Ident]types.Object),
+			Uses: make(map[*ast.Ident]types.Object),
+		}
+		config := types.Config{Importer: origImporter}
+		if _, err := config.Check(path, fset, unit.files, units[i].info); err != nil {
+			return nil, nil, "", fmt.Errorf("typecheck error: %v", err)
+		}
+	}
+
+	// Pick the new names, avoiding any name already in use.
+	used := make(map[string]bool)
+	for _, file := range allFiles {
+		ast.Inspect(file, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok {
+				used[ident.Name] = true
+			}
+			return true
+		})
+	}
+	unique := func(base string) string {
+		name := base
+		for n := 2; used[name] || types.Universe.Lookup(name) != nil || token.Lookup(name).IsKeyword(); n++ {
+			name = fmt.Sprintf("%s%d", base, n)
+		}
+		used[name] = true
+		return name
+	}
+	newNames := make(map[string]string) // by "path.name"
+	for i, pkg := range merged {
+		var inits []ast.Stmt
+		for _, file := range units[i].files {
+			for _, decl := range file.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "init" {
+					fn.Name.Name = unique("initFunc")
+					inits = append(inits, ah.ExprStmt(ah.CallExpr(ast.NewIdent(fn.Name.Name))))
+					continue
+				}
+				for _, ident := range declNames(decl) {
+					if ident.Name == "_" {
+						continue
+					}
+					r, size := utf8.DecodeRuneInString(ident.Name)
+					newNames[pkg.ImportPath+"."+ident.Name] = unique(string(unicode.ToLower(r)) + ident.Name[size:])
+				}
+			}
+		}
+		if len(inits) == 0 {
+			continue
+		}
+		// Init functions run after all package-level variables are
+		// initialized, including the main package's, so run them as part
+		// of the initialization of a variable declared after all others
+		// in the package instead.
+		last := units[i].files[len(units[i].files)-1]
+		last.Decls = append(last.Decls, &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names: []*ast.Ident{ast.NewIdent("_")},
+				Values: []ast.Expr{ah.LambdaCall(ast.NewIdent("bool"),
+					ah.BlockStmt(append(inits, ah.ReturnStmt(ast.NewIdent("true")))...))},
+			}},
+		})
+	}
+
+	// mergedName returns the new name for an object, if it's declared at
+	// the top level of a merged package.
+	mergedName := func(obj types.Object) string {
+		if obj == nil || obj.Pkg() == nil || obj.Parent() != obj.Pkg().Scope() {
+			return ""
+		}
+		return newNames[obj.Pkg().Path()+"."+obj.Name()]
+	}
+	for _, unit := range units {
+		info := unit.info
+		for _, file := range unit.files {
+			pre := func(cursor *astutil.Cursor) bool {
+				switch node := cursor.Node().(type) {
+				case *ast.SelectorExpr:
+					x, ok := node.X.(*ast.Ident)
+					if !ok {
+						return true
+					}
+					pkgName, ok := info.Uses[x].(*types.PkgName)
+					if !ok || !isMerged[pkgName.Imported().Path()] {
+						return true
+					}
+					cursor.Replace(ast.NewIdent(newNames[pkgName.Imported().Path()+"."+node.Sel.Name]))
+					return false
+				case *ast.Ident:
+					obj := info.ObjectOf(node)
+					if name := mergedName(obj); name != "" {
+						node.Name = name
+						break
+					}
+					// Embedded fields are named after their types.
+					if field, ok := obj.(*types.Var); ok && field.Embedded() {
+						if named := namedType(field.Type()); named != nil {
+							if name := mergedName(named.Obj()); name != "" {
+								node.Name = name
+							}
+						}
+					}
+				}
+				return true
+			}
+			astutil.Apply(file, pre, nil)
+			if err := removeMergedImports(file, isMerged); err != nil {
+				return nil, nil, "", err
+			}
+			file.Name.Name = "main"
+		}
+	}
+
+	// The compiler needs to find the packages imported by the merged ones.
+	var missing []string
+	seen := make(map[string]bool)
+	for _, file := range allFiles {
+		for _, spec := range file.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			if _, ok := buildInfo.imports[path]; !ok && path != "unsafe" && !seen[path] {
+				seen[path] = true
+				missing = append(missing, path)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return allFiles, allPaths, "", nil
+	}
+	importCfg, err = extendImportCfg(missing...)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return allFiles, allPaths, importCfg, nil
+}
+
+// declNames returns the names declared by a top-level declaration, excluding
+// methods.
+func declNames(decl ast.Decl) []*ast.Ident {
+	var names []*ast.Ident
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv == nil {
+			names = append(names, decl.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.ValueSpec:
+				names = append(names, spec.Names...)
+			case *ast.TypeSpec:
+				names = append(names, spec.Name)
+			}
+		}
+	}
+	return names
+}
+
+// removeMergedImports removes the imports of merged packages from a file,
+// whose uses were already rewritten.
+func removeMergedImports(file *ast.File, isMerged map[string]bool) error {
+	var imports []*ast.ImportSpec
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return err
+		}
+		if !isMerged[path] {
+			imports = append(imports, spec)
+			continue
+		}
+		if spec.Name != nil && spec.Name.Name == "." {
+			return fmt.Errorf("cannot merge %s: it is dot-imported", path)
+		}
+	}
+	file.Imports = imports
+
+	keep := make(map[*ast.ImportSpec]bool)
+	for _, spec := range imports {
+		keep[spec] = true
+	}
+	var decls []ast.Decl
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			var specs []ast.Spec
+			for _, spec := range gen.Specs {
+				if keep[spec.(*ast.ImportSpec)] {
+					specs = append(specs, spec)
+				}
+			}
+			if len(specs) == 0 {
+				continue
+			}
+			gen.Specs = specs
+		}
+		decls = append(decls, decl)
+	}
+	file.Decls = decls
+	return nil
+}
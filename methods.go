@@ -0,0 +1,136 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// setPrivateMethods works out which exported method names are only needed by
+// interfaces declared in private packages, and sets their new names in
+// cache.PrivateMethods.
+//
+// Exported methods are otherwise never obfuscated, since they might implement
+// an interface. A type in one package can implement an interface in another
+// without either importing the other, so the decision is made once for the
+// whole build, and by method name, as all methods with the same name must keep
+// matching. A method name qualifies if it's declared by an interface in a
+// private package, and if:
+//
+//   - No public package mentions it at all, as it could declare an interface
+//     with the method, or type-assert to one, or have a type with the method
+//     which is embedded in a private type.
+//   - No string literal in a private package mentions it, as it could be used
+//     via reflection, like in text/template.
+//   - No private method with the name is implemented outside Go.
+//
+// The new name is hashed with the seed and the import path of the first private
+// package declaring such an interface, rather than with its action ID, as
+// otherwise any change to that package would require rebuilding every other
+// package. That's why -privatemethods requires -seed.
+//
+// Since every public package must be scanned, this is only done with
+// -privatemethods.
+func setPrivateMethods() error {
+	var privatePaths, publicPaths []string
+	for path, pkg := range cache.ListedPackages {
+		if pkg.private {
+			privatePaths = append(privatePaths, path)
+		} else {
+			publicPaths = append(publicPaths, path)
+		}
+	}
+	sort.Strings(privatePaths)
+
+	declaredBy := make(map[string]string) // method name to package path
+	excluded := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, path := range privatePaths {
+		pkg := cache.ListedPackages[path]
+		for _, name := range append(pkg.GoFiles, pkg.CgoFiles...) {
+			file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, 0)
+			if err != nil {
+				return err
+			}
+			ast.Inspect(file, func(node ast.Node) bool {
+				switch node := node.(type) {
+				case *ast.InterfaceType:
+					for _, method := range node.Methods.List {
+						for _, name := range method.Names {
+							if _, ok := declaredBy[name.Name]; !ok && name.IsExported() {
+								declaredBy[name.Name] = path
+							}
+						}
+					}
+				case *ast.FuncDecl:
+					if node.Recv != nil && node.Body == nil {
+						excluded[node.Name.Name] = true
+					}
+				case *ast.BasicLit:
+					if node.Kind != token.STRING {
+						break
+					}
+					value, err := strconv.Unquote(node.Value)
+					if err != nil {
+						break
+					}
+					words := strings.FieldsFunc(value, func(r rune) bool {
+						return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+					})
+					for _, word := range words {
+						excluded[word] = true
+					}
+				}
+				return true
+			})
+		}
+	}
+	if len(declaredBy) == 0 {
+		return nil
+	}
+
+	for _, path := range publicPaths {
+		pkg := cache.ListedPackages[path]
+		for _, name := range append(pkg.GoFiles, pkg.CgoFiles...) {
+			src, err := ioutil.ReadFile(filepath.Join(pkg.Dir, name))
+			if err != nil {
+				return err
+			}
+			var s scanner.Scanner
+			s.Init(fset.AddFile(name, -1, len(src)), src, nil, 0)
+			for {
+				_, tok, lit := s.Scan()
+				if tok == token.EOF {
+					break
+				}
+				if tok == token.IDENT {
+					if _, ok := declaredBy[lit]; ok {
+						excluded[lit] = true
+					}
+				}
+			}
+		}
+	}
+
+	var names []string
+	for name := range declaredBy {
+		if !excluded[name] {
+			names = append(names, name)
+		}
+	}
+	scheme := namingSchemes[opts.Naming]
+	cache.PrivateMethods, _ = uniqueNames(names, nil, func(name string, attempt int) string {
+		return scheme.name([]byte(declaredBy[name]), name, attempt)
+	})
+	return nil
+}
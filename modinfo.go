@@ -0,0 +1,112 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// publicModInfo takes the _gomod_.go file generated by cmd/go for a main
+// package, and writes a copy of it to the shared temporary directory with only
+// the module information of public modules. It returns the path to the copy.
+//
+// The file looks like:
+//
+//	package main
+//	import _ "unsafe"
+//	//go:linkname __debug_modinfo__ runtime.modinfo
+//	var __debug_modinfo__ = "<16-byte marker>path\t...\nmod\t...\n<16-byte marker>"
+//
+// We don't obfuscate the copy in any other way, as the linker and tools like
+// "go version -m" expect to find the string data as-is.
+func publicModInfo(path string) (string, error) {
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	var lit *ast.BasicLit
+	for _, decl := range file.Decls {
+		decl, ok := decl.(*ast.GenDecl)
+		if !ok || decl.Tok != token.VAR {
+			continue
+		}
+		spec := decl.Specs[0].(*ast.ValueSpec)
+		if len(spec.Values) == 1 {
+			lit, _ = spec.Values[0].(*ast.BasicLit)
+		}
+	}
+	if lit == nil {
+		return "", fmt.Errorf("could not find the module info in %s", path)
+	}
+	info, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return "", err
+	}
+	lit.Value = strconv.Quote(filterModInfo(info))
+
+	tempFile, err := ioutil.TempFile(sharedTempDir, "_gomod_.*.go")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+	if err := printConfig.Fprint(tempFile, fset, file); err != nil {
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+// filterModInfo removes the main module, as well as any private modules, from
+// the module information embedded into a binary. Only the "dep" lines of public
+// modules are kept, along with their "=>" replacement lines.
+//
+// A replacement is dropped if it points to a directory or to a private module,
+// since that would leak the original source layout.
+func filterModInfo(info string) string {
+	// The info is surrounded by 16-byte markers, which we must keep.
+	const markerSize = 16
+	if len(info) < 2*markerSize {
+		return info
+	}
+	start, end := info[:markerSize], info[len(info)-markerSize:]
+	lines := strings.SplitAfter(info[markerSize:len(info)-markerSize], "\n")
+
+	var sb strings.Builder
+	sb.WriteString(start)
+	keepLast := false
+	for _, line := range lines {
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		switch fields[0] {
+		case "dep":
+			keepLast = len(fields) > 1 && !isPrivate(fields[1])
+			if keepLast {
+				sb.WriteString(line)
+			}
+		case "=>":
+			if !keepLast || len(fields) < 2 {
+				break
+			}
+			if err := module.CheckPath(fields[1]); err != nil || isPrivate(fields[1]) {
+				break
+			}
+			sb.WriteString(line)
+		default:
+			// The "path" and "mod" lines describe the main package and
+			// module, which are never kept.
+			keepLast = false
+		}
+	}
+	sb.WriteString(end)
+	return sb.String()
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/Binject/debug/goobj2"
+)
+
+// namingScheme decides the new names of identifiers, as chosen via -naming.
+//
+// Other packages and "garble reverse" must arrive at the same names, so a
+// scheme may only depend on the name, the seed, and the package declaring it.
+// Names which depend on more than that, such as the numbering of -naming=short,
+// are recorded in the package's name table; see nameTables.
+type namingScheme interface {
+	// name returns the new name for an identifier. Each attempt after the
+	// first must give a longer name, to avoid collisions.
+	name(actionID []byte, name string, attempt int) string
+}
+
+var namingSchemes = map[string]namingScheme{
+	"hash":   hashNaming{},
+	"short":  shortNaming{},
+	"words":  wordNaming{},
+	"random": randomNaming{},
+}
+
+// obfuscatedName returns the new name for an identifier declared in the package
+// with the given path and action ID.
+func obfuscatedName(actionID []byte, pkgPath, name string) string {
+	if newName, ok := nameTableOf(pkgPath)[name]; ok {
+		return newName
+	}
+	return namingSchemes[opts.Naming].name(actionID, name, 0)
+}
+
+// nameTables holds the new names decided when compiling each package, by
+// package path, which take precedence over the naming scheme. They are the
+// numbering of -naming=short, and the names which had to be made longer to
+// avoid collisions.
+//
+// The table is written to the object file of each package, so that other
+// packages, the linker, and "garble reverse" can read it back.
+var nameTables = make(map[string]map[string]string)
+
+// hashNaming gives names like zA0b_, a "z" followed by four hash characters.
+type hashNaming struct{}
+
+func (hashNaming) name(actionID []byte, name string, attempt int) string {
+	return hashWithLength(actionID, name, nameLength+attempt)
+}
+
+// shortNaming numbers the unexported names declared in a package, giving them
+// the shortest names which aren't used in it already, like a, b, and aa.
+// Exported names are hashed instead, since other packages would have to agree
+// on the numbering too.
+type shortNaming struct{}
+
+func (shortNaming) name(actionID []byte, name string, attempt int) string {
+	// The numbered names are in the name table.
+	return hashWithLength(actionID, name, nameLength+attempt)
+}
+
+// declaredNames returns the names declared in the package being compiled
+// which can be renamed: package-level names, fields, and methods.
+func (tf *transformer) declaredNames() []string {
+	declared := make(map[string]bool)
+	for ident, obj := range tf.info.Defs {
+		if obj == nil || obj.Pkg() != tf.pkg || ident.Name == "_" || ident.Name == "init" {
+			continue
+		}
+		if tf.pkg.Name() == "main" && ident.Name == "main" {
+			continue
+		}
+		global := obj.Parent() == tf.pkg.Scope()
+		switch obj := obj.(type) {
+		case *types.Var:
+			if obj.Embedded() {
+				continue // named after its type, which may be in another package
+			}
+			global = global || obj.IsField()
+		case *types.Func:
+			global = global || obj.Type().(*types.Signature).Recv() != nil
+		}
+		if global {
+			declared[ident.Name] = true
+		}
+	}
+	var names []string
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// usedNames returns the names of all identifiers in files.
+func usedNames(files []*ast.File) map[string]bool {
+	used := make(map[string]bool)
+	for _, file := range files {
+		ast.Inspect(file, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok {
+				used[ident.Name] = true
+			}
+			return true
+		})
+	}
+	return used
+}
+
+// setShortNames numbers the unexported names declared in the package being
+// compiled, skipping the names used anywhere in its files. The order depends
+// on the seed.
+func (tf *transformer) setShortNames(files []*ast.File) {
+	used := usedNames(files)
+	var names []string
+	for _, name := range tf.declaredNames() {
+		if !token.IsExported(name) {
+			names = append(names, name)
+		}
+	}
+	sums := make(map[string][]byte, len(names))
+	for _, name := range names {
+		sums[name] = nameSum(curActionID, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return bytes.Compare(sums[names[i]], sums[names[j]]) < 0 })
+
+	table := nameTableOf(curPkgPath)
+	n := 0
+	for _, name := range names {
+		for {
+			short := shortName(n)
+			n++
+			if !used[short] && !token.Lookup(short).IsKeyword() && types.Universe.Lookup(short) == nil {
+				table[name] = short
+				break
+			}
+		}
+	}
+}
+
+// avoidCollisions makes the new names declared in the package being compiled
+// longer where they would collide with each other, or with the names which are
+// kept in its files, such as local variables or the new names of other
+// packages. The latter include the fields and methods promoted from embedded
+// types, even if the package doesn't use them, as other packages might. It
+// returns a description of the collisions.
+func (tf *transformer) avoidCollisions(files []*ast.File) []string {
+	table := nameTableOf(curPkgPath)
+	reserved := usedNames(files)
+	for _, newName := range table {
+		reserved[newName] = true
+	}
+	for _, newName := range cache.PrivateMethods {
+		reserved[newName] = true
+	}
+	reserve := func(obj types.Object) {
+		pkg := obj.Pkg()
+		if pkg == nil || pkg == tf.pkg || !isPrivate(pkg.Path()) {
+			return
+		}
+		if actionID := buildInfo.imports[pkg.Path()].actionID; len(actionID) > 0 {
+			reserved[obfuscatedName(actionID, pkg.Path(), obj.Name())] = true
+		}
+	}
+	for _, obj := range tf.info.Uses {
+		reserve(obj)
+	}
+	seen := make(map[types.Type]bool)
+	var reserveMembers func(typ types.Type)
+	reserveMembers = func(typ types.Type) {
+		if seen[typ] {
+			return
+		}
+		seen[typ] = true
+		if _, ok := typ.Underlying().(*types.Interface); !ok {
+			if _, ok := typ.(*types.Pointer); !ok {
+				typ = types.NewPointer(typ)
+			}
+		}
+		mset := types.NewMethodSet(typ)
+		for i := 0; i < mset.Len(); i++ {
+			reserve(mset.At(i).Obj())
+		}
+		if ptr, ok := typ.(*types.Pointer); ok {
+			typ = ptr.Elem()
+		}
+		if strct, ok := typ.Underlying().(*types.Struct); ok {
+			for i := 0; i < strct.NumFields(); i++ {
+				field := strct.Field(i)
+				reserve(field)
+				if field.Embedded() {
+					reserveMembers(field.Type())
+				}
+			}
+		}
+	}
+	for _, obj := range tf.info.Defs {
+		if field, ok := obj.(*types.Var); ok && field.Embedded() {
+			reserveMembers(field.Type())
+		}
+	}
+	for _, tv := range tf.info.Types {
+		if iface, ok := tv.Type.(*types.Interface); ok && tv.IsType() {
+			for i := 0; i < iface.NumEmbeddeds(); i++ {
+				// Skip the type terms of constraints.
+				if embedded := iface.EmbeddedType(i); types.IsInterface(embedded) {
+					reserveMembers(embedded)
+				}
+			}
+		}
+	}
+
+	var names []string
+	for _, name := range tf.declaredNames() {
+		if _, ok := table[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	scheme := namingSchemes[opts.Naming]
+	newNames, log := uniqueNames(names, reserved, func(name string, attempt int) string {
+		return scheme.name(curActionID, name, attempt)
+	})
+	for name, newName := range newNames {
+		if newName != scheme.name(curActionID, name, 0) {
+			table[name] = newName
+		}
+	}
+	return log
+}
+
+// shortName returns the n-th shortest lowercase name, starting with a, b, ...,
+// z, aa, ab, and so on.
+func shortName(n int) string {
+	const first = "abcdefghijklmnopqrstuvwxyz"
+	const rest = first + "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+	// Find the length of the name, as there are 26 names of one character,
+	// 26*63 of two characters, and so on.
+	size, count := 1, len(first)
+	for n >= count {
+		n -= count
+		size++
+		count *= len(rest)
+	}
+	b := make([]byte, size)
+	for i := size - 1; i > 0; i-- {
+		b[i] = rest[n%len(rest)]
+		n /= len(rest)
+	}
+	b[0] = first[n]
+	return string(b)
+}
+
+// nameTableData encodes the name table of the package being compiled, to be
+// added to its object file.
+func nameTableData() []byte {
+	table := nameTables[curPkgPath]
+	var names []string
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", name, table[name])
+	}
+	return buf.Bytes()
+}
+
+// nameTableOf returns the name table of a package, reading it from its object
+// file if it isn't the package being compiled. Packages without any entries,
+// such as public ones, have an empty table.
+func nameTableOf(pkgPath string) map[string]string {
+	if table, ok := nameTables[pkgPath]; ok {
+		return table
+	}
+	table := make(map[string]string)
+	nameTables[pkgPath] = table
+	if pkgPath == curPkgPath {
+		return table
+	}
+
+	objPath := pkgPath
+	if objPath == "main" {
+		// The main package is known under its import path in the
+		// import config map.
+		objPath = buildInfo.firstImport
+	}
+	packagefile := buildInfo.imports[objPath].packagefile
+	if packagefile == "" {
+		return table
+	}
+	importMap := func(importPath string) (objectPath string) {
+		return buildInfo.imports[importPath].packagefile
+	}
+	pkg, err := goobj2.Parse(packagefile, objPath, importMap)
+	if err != nil {
+		panic(err) // shouldn't happen
+	}
+	for _, member := range pkg.ArchiveMembers {
+		if member.ArchiveHeader.Name != headerNames {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(member.ArchiveHeader.Data))
+		for scanner.Scan() {
+			if fields := strings.Split(scanner.Text(), "\t"); len(fields) == 2 {
+				table[fields[0]] = fields[1]
+			}
+		}
+	}
+	return table
+}
+
+// wordNaming gives plausible names made of three words, like parseBufferState.
+type wordNaming struct{}
+
+func (wordNaming) name(actionID []byte, name string, attempt int) string {
+	sum := nameSum(actionID, name)
+	var sb strings.Builder
+	for i := 0; i < 3+attempt; i++ {
+		word := nameWords[sum[i]]
+		if i > 0 || token.IsExported(name) {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		sb.WriteString(word)
+	}
+	return sb.String()
+}
+
+// nameWords are the 256 words used by wordNaming, one per byte value.
+var nameWords = [256]string{
+	"access", "account", "action", "active", "adapter", "address", "alert", "alias",
+	"align", "alloc", "amount", "anchor", "append", "apply", "archive", "args",
+	"array", "asset", "async", "attach", "attr", "audit", "auth", "backend",
+	"backup", "badge", "balance", "base", "batch", "before", "binary", "bind",
+	"block", "body", "bound", "branch", "bridge", "bucket", "buffer", "build",
+	"bundle", "byte", "cache", "call", "cancel", "canvas", "capture", "cell",
+	"chain", "change", "channel", "check", "child", "chunk", "cipher", "claim",
+	"class", "clean", "client", "clock", "clone", "close", "cluster", "code",
+	"codec", "collect", "column", "command", "commit", "common", "compact", "compare",
+	"compile", "config", "connect", "context", "control", "convert", "copy", "core",
+	"count", "create", "cursor", "cycle", "daemon", "data", "debug", "decode",
+	"delay", "delete", "delta", "depth", "detail", "device", "dialog", "digest",
+	"direct", "dirty", "disk", "dispatch", "domain", "draft", "driver", "dump",
+	"edge", "effect", "element", "embed", "empty", "encode", "engine", "entity",
+	"entry", "error", "event", "exec", "expand", "export", "extend", "extra",
+	"factor", "fetch", "field", "filter", "final", "flag", "flush", "focus",
+	"folder", "format", "frame", "future", "gate", "global", "graph", "group",
+	"guard", "handle", "hash", "header", "heap", "helper", "hidden", "history",
+	"holder", "hook", "host", "index", "info", "init", "inner", "input",
+	"insert", "inspect", "item", "join", "journal", "kernel", "key", "label",
+	"layer", "layout", "leader", "ledger", "level", "limit", "line", "link",
+	"list", "load", "local", "lock", "logger", "lookup", "manager", "mapping",
+	"marker", "match", "member", "memo", "merge", "message", "meta", "method",
+	"metric", "mirror", "mode", "model", "module", "monitor", "mount", "mutex",
+	"native", "network", "node", "notify", "number", "object", "offset", "option",
+	"order", "origin", "output", "owner", "packet", "page", "pair", "panel",
+	"param", "parent", "parse", "parser", "patch", "path", "peer", "pending",
+	"pipe", "pixel", "plan", "point", "policy", "pool", "port", "prefix",
+	"probe", "process", "profile", "proxy", "query", "queue", "quota", "range",
+	"reader", "record", "region", "remote", "render", "replica", "report", "request",
+	"reset", "result", "route", "rule", "sample", "scope", "score", "segment",
+	"sender", "server", "session", "shadow", "signal", "source", "state", "status",
+}
+
+// randomNaming gives random-looking names of six characters, without any which
+// look alike, such as l, I, 1, O, and 0.
+type randomNaming struct{}
+
+func (randomNaming) name(actionID []byte, name string, attempt int) string {
+	const lower = "abcdefghijkmnpqrstuvwxyz"
+	const upper = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	const rest = lower + upper + "23456789"
+	sum := nameSum(actionID, name)
+	b := make([]byte, 6+attempt)
+	if token.IsExported(name) {
+		b[0] = upper[int(sum[0])%len(upper)]
+	} else {
+		b[0] = lower[int(sum[0])%len(lower)]
+	}
+	for i := 1; i < len(b); i++ {
+		b[i] = rest[int(sum[i])%len(rest)]
+	}
+	// Six lowercase letters could spell a keyword like "return", or a
+	// predeclared name like "string".
+	if token.Lookup(string(b)).IsKeyword() || types.Universe.Lookup(string(b)) != nil {
+		b = append(b, rest[int(sum[len(b)])%len(rest)])
+	}
+	return string(b)
+}
@@ -0,0 +1,372 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+
+	ah "mvdan.cc/garble/internal/asthelper"
+)
+
+// defaultOpaqueDensity is the density used by -opaque without a value.
+const defaultOpaqueDensity = 20
+
+// opaqueFlag implements -opaque, a boolean flag which also accepts a density
+// as a percentage of statements, such as -opaque=50.
+type opaqueFlag struct{}
+
+func (opaqueFlag) IsBoolFlag() bool { return true }
+
+func (opaqueFlag) String() string {
+	if flagOpaque == 0 {
+		return "false"
+	}
+	return strconv.Itoa(flagOpaque)
+}
+
+func (opaqueFlag) Set(s string) error {
+	if enabled, err := strconv.ParseBool(s); err == nil {
+		flagOpaque = 0
+		if enabled {
+			flagOpaque = defaultOpaqueDensity
+		}
+		return nil
+	}
+	density, err := strconv.Atoi(s)
+	if err != nil || density < 1 || density > 100 {
+		return fmt.Errorf("must be a boolean or a density from 1 to 100")
+	}
+	flagOpaque = density
+	return nil
+}
+
+// addOpaquePredicates adds branches on opaque predicates to the functions in a
+// file, which are conditions that always have the same result but which the
+// compiler can't tell apart from any other. With -opaque=N, about N% of the
+// statements either get a junk block which never runs before them, or are
+// themselves wrapped in a branch with a junk block on its other side.
+//
+// The predicates are built from arithmetic identities which hold for any
+// integer, even when it overflows. Their operands are local variables of type
+// int, as long as no other goroutine could modify them, and a package-level
+// variable which is only ever written to by the junk blocks.
+func (tf *transformer) addOpaquePredicates(files []*ast.File, file *ast.File, name string) {
+	if strings.HasPrefix(name, "_cgo_") {
+		return
+	}
+	o := &opaquer{
+		tf:      tf,
+		files:   files,
+		rand:    newRand("opaque", name),
+		density: opts.Opaque,
+	}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil || hasCompilerDirective(fn.Doc) {
+			continue
+		}
+		// Collect the bodies first, as we only add to statement lists.
+		bodies := []*ast.FuncLit{{Type: fn.Type, Body: fn.Body}}
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			if lit, ok := node.(*ast.FuncLit); ok {
+				bodies = append(bodies, lit)
+			}
+			return true
+		})
+		o.escaping = escapingVars(tf.info, fn.Body)
+		for _, lit := range bodies {
+			var vars []*types.Var
+			for _, field := range lit.Type.Params.List {
+				for _, name := range field.Names {
+					vars = o.addVar(vars, name)
+				}
+			}
+			lit.Body.List = o.list(lit.Body.List, vars)
+		}
+	}
+	if o.global != nil {
+		name := ast.NewIdent(o.global.Name())
+		tf.info.Defs[name] = o.global
+		file.Decls = append(file.Decls, &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names:  []*ast.Ident{name},
+				Values: []ast.Expr{ah.IntLit(0)},
+			}},
+		})
+	}
+}
+
+// hasCompilerDirective reports whether a comment group contains a //go:
+// directive, such as go:nosplit.
+func hasCompilerDirective(group *ast.CommentGroup) bool {
+	if group == nil {
+		return false
+	}
+	for _, comment := range group.List {
+		if strings.HasPrefix(comment.Text, "//go:") {
+			return true
+		}
+	}
+	return false
+}
+
+type opaquer struct {
+	tf      *transformer
+	files   []*ast.File
+	rand    *mathrand.Rand
+	density int
+
+	escaping map[*types.Var]bool
+	global   *types.Var // declared at the end, if used
+	vars     []*types.Var
+}
+
+// list adds branches to a list of statements, given the usable variables which
+// are in scope at its start.
+func (o *opaquer) list(list []ast.Stmt, vars []*types.Var) []ast.Stmt {
+	var result []ast.Stmt
+	for i, stmt := range list {
+		o.nested(stmt, vars)
+		if o.rand.Intn(100) < o.density {
+			o.vars = vars
+			// A statement which ends a list may need to stay
+			// there, such as a final return or fallthrough.
+			if i < len(list)-1 && isPlainStmt(stmt) && o.rand.Intn(2) == 0 {
+				stmt = &ast.IfStmt{
+					Cond: o.predicate(true),
+					Body: ah.BlockStmt(stmt),
+					Else: o.junk(),
+				}
+			} else {
+				result = append(result, &ast.IfStmt{
+					Cond: o.predicate(false),
+					Body: o.junk(),
+				})
+			}
+		}
+		result = append(result, stmt)
+		vars = o.declared(vars, stmt)
+	}
+	return result
+}
+
+// isPlainStmt reports whether a statement can be moved to a block of its own,
+// as it doesn't declare anything.
+func isPlainStmt(stmt ast.Stmt) bool {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt, *ast.IncDecStmt, *ast.SendStmt:
+		return true
+	case *ast.AssignStmt:
+		return stmt.Tok != token.DEFINE
+	}
+	return false
+}
+
+// nested adds branches to the statement lists within a statement.
+func (o *opaquer) nested(stmt ast.Stmt, vars []*types.Var) {
+	// Don't let the appends in nested lists overwrite each other.
+	vars = vars[:len(vars):len(vars)]
+	switch stmt := stmt.(type) {
+	case *ast.LabeledStmt:
+		o.nested(stmt.Stmt, vars)
+	case *ast.BlockStmt:
+		stmt.List = o.list(stmt.List, vars)
+	case *ast.IfStmt:
+		vars = o.declared(vars, stmt.Init)
+		stmt.Body.List = o.list(stmt.Body.List, vars)
+		if stmt.Else != nil {
+			o.nested(stmt.Else, vars)
+		}
+	case *ast.ForStmt:
+		vars = o.declared(vars, stmt.Init)
+		stmt.Body.List = o.list(stmt.Body.List, vars)
+	case *ast.RangeStmt:
+		if stmt.Tok == token.DEFINE {
+			for _, expr := range []ast.Expr{stmt.Key, stmt.Value} {
+				if ident, ok := expr.(*ast.Ident); ok {
+					vars = o.addVar(vars, ident)
+				}
+			}
+		}
+		stmt.Body.List = o.list(stmt.Body.List, vars)
+	case *ast.SwitchStmt:
+		vars = o.declared(vars, stmt.Init)
+		for _, clause := range stmt.Body.List {
+			clause := clause.(*ast.CaseClause)
+			clause.Body = o.list(clause.Body, vars)
+		}
+	case *ast.TypeSwitchStmt:
+		vars = o.declared(vars, stmt.Init)
+		for _, clause := range stmt.Body.List {
+			clause := clause.(*ast.CaseClause)
+			clause.Body = o.list(clause.Body, vars)
+		}
+	case *ast.SelectStmt:
+		for _, clause := range stmt.Body.List {
+			clause := clause.(*ast.CommClause)
+			clause.Body = o.list(clause.Body, o.declared(vars, clause.Comm))
+		}
+	}
+}
+
+// declared adds the usable variables declared by a statement.
+func (o *opaquer) declared(vars []*types.Var, stmt ast.Stmt) []*types.Var {
+	switch stmt := stmt.(type) {
+	case *ast.LabeledStmt:
+		return o.declared(vars, stmt.Stmt)
+	case *ast.AssignStmt:
+		if stmt.Tok == token.DEFINE {
+			for _, expr := range stmt.Lhs {
+				vars = o.addVar(vars, expr.(*ast.Ident))
+			}
+		}
+	case *ast.DeclStmt:
+		if decl := stmt.Decl.(*ast.GenDecl); decl.Tok == token.VAR {
+			for _, spec := range decl.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					vars = o.addVar(vars, name)
+				}
+			}
+		}
+	}
+	return vars
+}
+
+// addVar adds a declared variable, if it's an int which can't be modified by
+// other goroutines, since that would be a data race.
+func (o *opaquer) addVar(vars []*types.Var, name *ast.Ident) []*types.Var {
+	v, ok := o.tf.info.Defs[name].(*types.Var)
+	if !ok || v.Name() == "_" || o.escaping[v] || !types.Identical(v.Type(), types.Typ[types.Int]) {
+		return vars
+	}
+	return append(vars, v)
+}
+
+// operand returns a reference to one of the usable variables.
+func (o *opaquer) operand() ast.Expr {
+	if o.global == nil {
+		o.global = types.NewVar(token.NoPos, o.tf.pkg, o.tf.globalName(o.files, "opaque"), types.Typ[types.Int])
+	}
+	v := o.global
+	if n := o.rand.Intn(len(o.vars) + 1); n < len(o.vars) {
+		v = o.vars[n]
+	}
+	ident := ast.NewIdent(v.Name())
+	o.tf.info.Uses[ident] = v
+	return ident
+}
+
+func paren(x ast.Expr) ast.Expr { return &ast.ParenExpr{X: x} }
+
+func binaryExpr(x ast.Expr, op token.Token, y ast.Expr) ast.Expr {
+	return &ast.BinaryExpr{X: x, Op: op, Y: y}
+}
+
+// predicate returns a condition which is always true, or always false if want
+// is false.
+func (o *opaquer) predicate(want bool) ast.Expr {
+	var cond *ast.BinaryExpr
+	switch o.rand.Intn(5) {
+	case 0:
+		// x*(x+1) is always even.
+		x := o.operand()
+		product := binaryExpr(x, token.MUL, paren(binaryExpr(o.operand2(x), token.ADD, ah.IntLit(1))))
+		cond = &ast.BinaryExpr{X: paren(binaryExpr(paren(product), token.AND, ah.IntLit(1))), Op: token.EQL, Y: ah.IntLit(0)}
+	case 1:
+		// A square is always 0 or 1 modulo 4.
+		x := o.operand()
+		square := binaryExpr(x, token.MUL, o.operand2(x))
+		cond = &ast.BinaryExpr{X: paren(binaryExpr(paren(square), token.AND, ah.IntLit(3))), Op: token.NEQ, Y: ah.IntLit(2)}
+	case 2:
+		// (x|y) + (x&y) == x + y
+		x, y := o.operand(), o.operand()
+		sum := binaryExpr(paren(binaryExpr(x, token.OR, y)), token.ADD, paren(binaryExpr(o.operand2(x), token.AND, o.operand2(y))))
+		cond = &ast.BinaryExpr{X: sum, Op: token.EQL, Y: binaryExpr(o.operand2(x), token.ADD, o.operand2(y))}
+	case 3:
+		// (x^y) + 2*(x&y) == x + y
+		x, y := o.operand(), o.operand()
+		carry := binaryExpr(ah.IntLit(2), token.MUL, paren(binaryExpr(o.operand2(x), token.AND, o.operand2(y))))
+		sum := binaryExpr(paren(binaryExpr(x, token.XOR, y)), token.ADD, carry)
+		cond = &ast.BinaryExpr{X: sum, Op: token.EQL, Y: binaryExpr(o.operand2(x), token.ADD, o.operand2(y))}
+	default:
+		// x*(x+1) is even, so its square is a multiple of 4.
+		x := o.operand()
+		product := paren(binaryExpr(x, token.MUL, paren(binaryExpr(o.operand2(x), token.ADD, ah.IntLit(1)))))
+		square := binaryExpr(product, token.MUL, o.copyExpr(product))
+		cond = &ast.BinaryExpr{X: paren(binaryExpr(paren(square), token.AND, ah.IntLit(3))), Op: token.EQL, Y: ah.IntLit(0)}
+	}
+	if !want {
+		if cond.Op == token.EQL {
+			cond.Op = token.NEQ
+		} else {
+			cond.Op = token.EQL
+		}
+	}
+	return cond
+}
+
+// operand2 returns another reference to the same variable as an operand.
+func (o *opaquer) operand2(x ast.Expr) ast.Expr {
+	ident := x.(*ast.Ident)
+	dup := ast.NewIdent(ident.Name)
+	o.tf.info.Uses[dup] = o.tf.info.Uses[ident]
+	return dup
+}
+
+// copyExpr copies an expression made up of operands, literals, and binary and
+// paren expressions.
+func (o *opaquer) copyExpr(expr ast.Expr) ast.Expr {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return o.operand2(expr)
+	case *ast.BasicLit:
+		return &ast.BasicLit{Kind: expr.Kind, Value: expr.Value}
+	case *ast.ParenExpr:
+		return paren(o.copyExpr(expr.X))
+	case *ast.BinaryExpr:
+		return binaryExpr(o.copyExpr(expr.X), expr.Op, o.copyExpr(expr.Y))
+	}
+	panic(fmt.Sprintf("unexpected expression: %T", expr))
+}
+
+// junk returns a block which only modifies the package-level variable, as it
+// never runs.
+func (o *opaquer) junk() *ast.BlockStmt {
+	block := &ast.BlockStmt{}
+	for n := 1 + o.rand.Intn(3); n > 0; n-- {
+		x := o.operand()
+		global := ast.NewIdent(o.global.Name())
+		o.tf.info.Uses[global] = o.global
+
+		var stmt ast.Stmt
+		switch o.rand.Intn(4) {
+		case 0:
+			stmt = &ast.AssignStmt{Lhs: []ast.Expr{global}, Tok: token.ADD_ASSIGN, Rhs: []ast.Expr{
+				binaryExpr(x, token.MUL, ah.IntLit(3+2*o.rand.Intn(50))),
+			}}
+		case 1:
+			stmt = &ast.AssignStmt{Lhs: []ast.Expr{global}, Tok: token.XOR_ASSIGN, Rhs: []ast.Expr{
+				binaryExpr(x, token.SHL, ah.IntLit(1+o.rand.Intn(7))),
+			}}
+		case 2:
+			stmt = &ast.AssignStmt{Lhs: []ast.Expr{global}, Tok: token.SUB_ASSIGN, Rhs: []ast.Expr{
+				binaryExpr(x, token.AND, ah.IntLit(o.rand.Intn(256))),
+			}}
+		default:
+			stmt = &ast.IfStmt{
+				Cond: binaryExpr(x, token.GTR, ah.IntLit(o.rand.Intn(1000))),
+				Body: ah.BlockStmt(&ast.IncDecStmt{X: global, Tok: token.INC}),
+			}
+		}
+		block.List = append(block.List, stmt)
+	}
+	return block
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/types"
+	"io/ioutil"
+	"sort"
+
+	"github.com/Binject/debug/goobj2"
+)
+
+// buildReport is the JSON document written by -report.
+type buildReport struct {
+	Packages []*packageReport `json:"packages"`
+}
+
+// packageReport describes how a single package was obfuscated.
+type packageReport struct {
+	ImportPath string `json:"importPath"`
+
+	// Renamed and Preserved count the package's declared names by kind,
+	// such as "func" or "field". Local names are not counted, as they
+	// never show up in the binary.
+	Renamed   map[string]int `json:"renamed,omitempty"`
+	Preserved map[string]int `json:"preserved,omitempty"`
+
+	// LiteralsObfuscated counts the obfuscated literals by obfuscator.
+	LiteralsObfuscated map[string]int `json:"literalsObfuscated,omitempty"`
+	// LiteralsTooLarge counts the literals left as-is due to their size.
+	LiteralsTooLarge int `json:"literalsTooLarge,omitempty"`
+
+	// RuntimeStripped lists the runtime functions whose bodies were
+	// removed with -tiny.
+	RuntimeStripped []string `json:"runtimeStripped,omitempty"`
+}
+
+// reportKind returns the kind an object is counted under in a packageReport,
+// or an empty string if it is not counted.
+func reportKind(obj types.Object) string {
+	global := obj.Parent() == obj.Pkg().Scope()
+	switch obj := obj.(type) {
+	case *types.Func:
+		if obj.Type().(*types.Signature).Recv() != nil {
+			return "method"
+		}
+		return "func"
+	case *types.TypeName:
+		if global {
+			return "type"
+		}
+	case *types.Var:
+		if obj.IsField() {
+			return "field"
+		}
+		if global {
+			return "var"
+		}
+	}
+	return ""
+}
+
+// countNames fills the Renamed and Preserved counts of the report, once
+// transformGo has been run on all files.
+func (tf *transformer) countNames() {
+	counted := make(map[types.Object]bool)
+	for ident, obj := range tf.info.Defs {
+		if obj == nil || obj.Pkg() != tf.pkg || ident.Name == "_" || counted[obj] {
+			continue
+		}
+		counted[obj] = true
+		kind := reportKind(obj)
+		if kind == "" {
+			continue
+		}
+		if tf.renamed[obj] {
+			if tf.report.Renamed == nil {
+				tf.report.Renamed = make(map[string]int)
+			}
+			tf.report.Renamed[kind]++
+		} else {
+			if tf.report.Preserved == nil {
+				tf.report.Preserved = make(map[string]int)
+			}
+			tf.report.Preserved[kind]++
+		}
+	}
+}
+
+// writeReport merges the reports of the packages in a build into a single JSON
+// file. Like "garble explain", we use "go list -export" to get the object file
+// of each package, which holds its report. That way, packages and binaries
+// from the build cache are included too.
+//
+// It must be called after the build, reusing its options and shared data, so
+// that the listed export files are the ones just built, even with -seed=random.
+func writeReport(path string, buildArgs []string) error {
+	flags, patterns := splitFlagsFromArgs(buildArgs)
+	listArgs := []string{
+		"-json",
+		"-deps",
+		"-export",
+	}
+	listArgs = append(listArgs, filterBuildFlags(flags)...)
+	cmd := goCmd("list", listArgs, patterns)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go list error: %v: %s", err, stderr.Bytes())
+	}
+
+	var pkgs []listedPackage
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var pkg listedPackage
+		if err := dec.Decode(&pkg); err != nil {
+			return err
+		}
+		if pkg.Export == "" {
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+		buildInfo.imports[pkg.ImportPath] = importedPkg{packagefile: pkg.Export}
+	}
+	importMap := func(importPath string) (objectPath string) {
+		return buildInfo.imports[importPath].packagefile
+	}
+
+	var report buildReport
+	for _, pkg := range pkgs {
+		// Only private packages are obfuscated, but with -tiny, the
+		// runtime is stripped too.
+		if !opts.Tiny && !isPrivate(pkg.ImportPath) {
+			continue
+		}
+		objPkg, err := goobj2.Parse(pkg.Export, pkg.ImportPath, importMap)
+		if err != nil {
+			return err
+		}
+		for _, member := range objPkg.ArchiveMembers {
+			if member.ArchiveHeader.Name != headerReport {
+				continue
+			}
+			pkgReport := new(packageReport)
+			if err := json.Unmarshal(member.ArchiveHeader.Data, pkgReport); err != nil {
+				return err
+			}
+			// The main package is compiled as "main".
+			pkgReport.ImportPath = pkg.ImportPath
+			report.Packages = append(report.Packages, pkgReport)
+			break
+		}
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].ImportPath < report.Packages[j].ImportPath
+	})
+
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0o666)
+}
@@ -14,6 +14,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -91,16 +92,67 @@ func commandReverse(args []string) error {
 	// export data only exposes exported names. Parsing Go files is cheap,
 	// so it's unnecessary to try to avoid this cost.
 	var replaces []string
+	// Names from -naming=short are too short to be replaced on their own,
+	// so they are only replaced along with their package and receiver.
+	var qualified [][2]string
 	fset := token.NewFileSet()
 
+	// Package paths are hashed depending on all the private packages in the
+	// binary, just like when linking.
+	buildInfo.firstImport = mainPkgPath
+	setImportHashes(privatePkgPaths)
+	if hashed, ok := importHashes["main"]; ok {
+		replaces = append(replaces, hashed, "main")
+	}
+	for name, newName := range cache.PrivateMethods {
+		replaces = append(replaces, newName, name)
+	}
+
 	for _, pkgPath := range privatePkgPaths {
 		ipkg := buildInfo.imports[pkgPath]
-		addReplace := func(str string) {
-			replaces = append(replaces, hashWith(ipkg.actionID, str), str)
-		}
 
 		// Package paths are obfuscated, too.
-		addReplace(pkgPath)
+		replaces = append(replaces, importHashes[pkgPath], pkgPath)
+		pkgName, obfPkgNames := pkgPath, []string{importHashes[pkgPath]}
+		if pkgPath == mainPkgPath {
+			// Its symbols use "main", which may be hashed too.
+			pkgName, obfPkgNames = "main", []string{"main", importHashes["main"]}
+		}
+		addName := func(decl *ast.FuncDecl) {
+			name := decl.Name.Name
+			obfName := obfuscatedName(ipkg.actionID, pkgPath, name)
+			if opts.Naming != "short" || token.IsExported(name) || nameTableOf(pkgPath)[name] == "" {
+				replaces = append(replaces, obfName, name)
+				return
+			}
+			var qualifiedName, obfQualifiedName []string
+			if decl.Recv == nil {
+				qualifiedName = append(qualifiedName, "."+name)
+				obfQualifiedName = append(obfQualifiedName, "."+obfName)
+			} else {
+				recv := decl.Recv.List[0].Type
+				star := false
+				if expr, ok := recv.(*ast.StarExpr); ok {
+					recv, star = expr.X, true
+				}
+				ident, ok := recv.(*ast.Ident)
+				if !ok {
+					return
+				}
+				obfRecv := obfuscatedName(ipkg.actionID, pkgPath, ident.Name)
+				if star {
+					qualifiedName = append(qualifiedName, ".(*"+ident.Name+")."+name)
+					obfQualifiedName = append(obfQualifiedName, ".(*"+obfRecv+")."+obfName)
+				}
+				qualifiedName = append(qualifiedName, "."+ident.Name+"."+name)
+				obfQualifiedName = append(obfQualifiedName, "."+obfRecv+"."+obfName)
+			}
+			for _, obfPkgName := range obfPkgNames {
+				for i := range qualifiedName {
+					qualified = append(qualified, [2]string{obfPkgName + obfQualifiedName[i], pkgName + qualifiedName[i]})
+				}
+			}
+		}
 
 		lpkg, err := listPackage(pkgPath)
 		if err != nil {
@@ -116,12 +168,35 @@ func commandReverse(args []string) error {
 				// TODO: Probably do type names too. What else?
 				switch decl := decl.(type) {
 				case *ast.FuncDecl:
-					addReplace(decl.Name.Name)
+					addName(decl)
 				}
 			}
 		}
+
+		// File names are obfuscated with -shufflefiles, which records
+		// the original ones in the object file.
+		fileNames, err := fileNamesOf(pkgPath)
+		if err != nil {
+			return err
+		}
+		for newName, origNames := range fileNames {
+			replaces = append(replaces, newName, origNames)
+		}
+	}
+	// The replacer prefers earlier pairs, and a short name like "a" must
+	// not take priority over a longer one like "ab". Names made longer to
+	// avoid a collision start with the name they collided with, too.
+	for i := 0; i < len(replaces); i += 2 {
+		qualified = append(qualified, [2]string{replaces[i], replaces[i+1]})
+	}
+	sort.SliceStable(qualified, func(i, j int) bool {
+		return len(qualified[i][0]) > len(qualified[j][0])
+	})
+	var pairs []string
+	for _, pair := range qualified {
+		pairs = append(pairs, pair[0], pair[1])
 	}
-	repl := strings.NewReplacer(replaces...)
+	repl := strings.NewReplacer(pairs...)
 
 	// TODO: return a non-zero status code if we could not reverse any string.
 	if len(args) == 0 {
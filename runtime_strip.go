@@ -14,7 +14,9 @@ import (
 // stripRuntime removes unnecessary code from the runtime,
 // such as panic and fatal error printing, and code that
 // prints trace/debug info of the runtime.
-func stripRuntime(filename string, file *ast.File) {
+//
+// It returns the names of the functions whose bodies were stripped.
+func stripRuntime(filename string, file *ast.File) (stripped []string) {
 	stripPrints := func(node ast.Node) bool {
 		call, ok := node.(*ast.CallExpr)
 		if !ok {
@@ -37,6 +39,10 @@ func stripRuntime(filename string, file *ast.File) {
 	for _, decl := range file.Decls {
 		switch x := decl.(type) {
 		case *ast.FuncDecl:
+			if x.Body == nil {
+				continue // implemented in assembly
+			}
+			body, bodyLen := x.Body, len(x.Body.List)
 			switch filename {
 			case "error.go":
 				// only used in panics
@@ -102,6 +108,9 @@ func stripRuntime(filename string, file *ast.File) {
 			default:
 				break
 			}
+			if x.Body != body || len(x.Body.List) != bodyLen {
+				stripped = append(stripped, x.Name.Name)
+			}
 		case *ast.GenDecl:
 			if x.Tok != token.IMPORT {
 				continue
@@ -121,13 +130,14 @@ func stripRuntime(filename string, file *ast.File) {
 
 	if filename == "print.go" {
 		file.Decls = append(file.Decls, hidePrintDecl)
-		return
+		return stripped
 	}
 
 	// replace all 'print' and 'println' statements in
 	// the runtime with an empty func, which will be
 	// optimized out by the compiler
 	ast.Inspect(file, stripPrints)
+	return stripped
 }
 
 func removeImport(importPath string, specs []ast.Spec) []ast.Spec {
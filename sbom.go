@@ -0,0 +1,234 @@
+// Copyright (c) 2021, The Garble Authors.
+// See LICENSE for licensing information.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spdxDocument is the subset of an SPDX 2.2 JSON document that we fill.
+// See https://spdx.github.io/spdx-spec/ for the full specification.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// writeSBOM writes an SPDX document listing all the modules which were part of
+// the build, as obtained by setListedPackages. Since garble strips the module
+// information from binaries, this serves as the source of truth for tools such
+// as vulnerability scanners.
+//
+// Replaced modules are listed as the replacement that was built, with the
+// original module in the source info. Replacements by a local directory have
+// no version.
+func writeSBOM(path string) error {
+	modules := make(map[string]*listedModule)
+	for _, pkg := range cache.ListedPackages {
+		if mod := pkg.Module; mod != nil { // nil for the standard library
+			modules[mod.Path] = mod
+		}
+	}
+
+	created, err := sbomCreated()
+	if err != nil {
+		return err
+	}
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.2",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        "garble build",
+		CreationInfo: spdxCreationInfo{
+			Created:  created,
+			Creators: []string{"Tool: garble-" + version},
+		},
+	}
+	type sbomModule struct {
+		name       string
+		built      *listedModule // the replacement, if any
+		main       bool
+		sourceInfo string
+	}
+	var mods []sbomModule
+	for _, mod := range modules {
+		name, err := sbomName(mod, mod.Path)
+		if err != nil {
+			return err
+		}
+		sm := sbomModule{name: name, built: mod, main: mod.Main}
+		if r := mod.Replace; r != nil {
+			original := name
+			if mod.Version != "" {
+				original += "@" + mod.Version
+			}
+			if r.Version != "" {
+				if sm.name, err = sbomName(mod, r.Path); err != nil {
+					return err
+				}
+				sm.built = r
+				sm.sourceInfo = "replacement for " + original
+			} else {
+				sm.built = &listedModule{Path: mod.Path}
+				sm.sourceInfo = "replaced by a local directory"
+			}
+		}
+		mods = append(mods, sm)
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].name < mods[j].name })
+	var mainID string
+	var depIDs []string
+	for i, sm := range mods {
+		mod := sm.built
+		spdxPkg := spdxPackage{
+			Name:             sm.name,
+			SPDXID:           fmt.Sprintf("SPDXRef-Module-%d", i),
+			VersionInfo:      mod.Version,
+			DownloadLocation: "NOASSERTION",
+			SourceInfo:       sm.sourceInfo,
+		}
+		if sm.main {
+			spdxPkg.VersionInfo = "(devel)"
+			doc.Name = spdxPkg.Name
+			mainID = spdxPkg.SPDXID
+		} else {
+			depIDs = append(depIDs, spdxPkg.SPDXID)
+		}
+		if sum := strings.TrimPrefix(mod.Sum, "h1:"); sum != mod.Sum {
+			// The "h1:" checksums are base64-encoded SHA-256 sums.
+			if raw, err := base64.StdEncoding.DecodeString(sum); err == nil {
+				spdxPkg.Checksums = []spdxChecksum{{
+					Algorithm:     "SHA256",
+					ChecksumValue: hex.EncodeToString(raw),
+				}}
+			}
+		}
+		if spdxPkg.Name == mod.Path && mod.Version != "" {
+			spdxPkg.ExternalRefs = []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  fmt.Sprintf("pkg:golang/%s@%s", mod.Path, mod.Version),
+			}}
+		}
+		doc.Packages = append(doc.Packages, spdxPkg)
+	}
+
+	// The namespace must be unique per document; derive it from the
+	// contents, so that it's stable across identical builds.
+	h := sha256.New()
+	for _, spdxPkg := range doc.Packages {
+		fmt.Fprintf(h, "%s %s\n", spdxPkg.Name, spdxPkg.VersionInfo)
+	}
+	doc.DocumentNamespace = "https://spdx.org/spdxdocs/garble-" + hashToString(h.Sum(nil))
+
+	if mainID != "" {
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: mainID,
+		})
+		for _, id := range depIDs {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      mainID,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: id,
+			})
+		}
+	}
+
+	data, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0o666)
+}
+
+// sbomCreated returns the creation time of the SBOM, which is taken from
+// SOURCE_DATE_EPOCH if set, so that builds can be reproducible.
+func sbomCreated() (string, error) {
+	created := time.Now()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+		}
+		created = time.Unix(secs, 0)
+	}
+	return created.UTC().Format(time.RFC3339), nil
+}
+
+// sbomName returns the name a module is listed under in the SBOM, given the
+// path of the module or its replacement. With -sbomhash, private modules are
+// hashed.
+//
+// Modules don't have an action ID like packages do, so we salt the hash with
+// the action ID of the module's first package in the build.
+func sbomName(mod *listedModule, path string) (string, error) {
+	if !flagSBOMHash || !isPrivate(mod.Path) {
+		return path, nil
+	}
+	var pkgPaths []string
+	for pkgPath, pkg := range cache.ListedPackages {
+		if pkg.Module != nil && pkg.Module.Path == mod.Path && pkg.Export != "" {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	if len(pkgPaths) == 0 {
+		return "", fmt.Errorf("no packages built for module %s", mod.Path)
+	}
+	sort.Strings(pkgPaths)
+	buildID, err := buildidOf(cache.ListedPackages[pkgPaths[0]].Export)
+	if err != nil {
+		return "", err
+	}
+	return hashWith(decodeHash(splitActionID(buildID)), path), nil
+}
@@ -12,6 +12,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"mvdan.cc/garble/internal/literals"
 )
 
 // shared this data is shared between the different garble processes
@@ -21,6 +23,10 @@ type shared struct {
 
 	Options        options        // garble options being used, i.e. our own flags
 	ListedPackages listedPackages // non-garbled view of all packages to build
+
+	// PrivateMethods holds the new names of the exported methods which are
+	// only needed by private interfaces; see setPrivateMethods.
+	PrivateMethods map[string]string
 }
 
 var cache *shared
@@ -64,12 +70,28 @@ func saveShared() (string, error) {
 
 // options are derived from the flags
 type options struct {
-	GarbleLiterals bool
-	Tiny           bool
-	GarbleDir      string
-	DebugDir       string
-	Seed           []byte
-	Random         bool
+	GarbleLiterals   bool
+	LiteralLevel     literals.Level
+	LiteralOverrides []literalOverride
+	LiteralCache     literals.Cache
+	LiteralMaxSize   int
+	ControlFlow      bool
+	Opaque           int
+	MBA              bool
+	IndirectCalls    bool
+	ShuffleFields    bool
+	ShuffleFiles     bool
+	MergePkgs        string
+	Naming           string
+	PrivateMethods   bool
+	Tiny             bool
+	ModInfo          bool
+	Explain          bool
+	Report           bool
+	GarbleDir        string
+	DebugDir         string
+	Seed             []byte
+	Random           bool
 }
 
 // setOptions sets all options from the user supplied flags.
@@ -80,9 +102,32 @@ func setOptions() error {
 	}
 
 	opts = &options{
-		GarbleDir:      wd,
-		GarbleLiterals: flagGarbleLiterals,
-		Tiny:           flagGarbleTiny,
+		GarbleDir:        wd,
+		GarbleLiterals:   flagGarbleLiterals,
+		LiteralLevel:     flagLiteralLevel,
+		LiteralOverrides: flagLiteralOverrides,
+		LiteralMaxSize:   flagLiteralMaxSize,
+		ControlFlow:      flagControlFlow,
+		Opaque:           flagOpaque,
+		MBA:              flagMBA,
+		IndirectCalls:    flagIndirectCalls,
+		ShuffleFields:    flagShuffleFields,
+		ShuffleFiles:     flagShuffleFiles,
+		MergePkgs:        flagMergePkgs,
+		Naming:           flagNaming,
+		PrivateMethods:   flagPrivateMethods,
+		Tiny:             flagGarbleTiny,
+		ModInfo:          flagModInfo,
+		Explain:          flagExplain,
+		Report:           flagReport != "",
+	}
+
+	if opts.LiteralCache, err = literals.ParseCache(flagLiteralCache); err != nil {
+		return err
+	}
+
+	if _, ok := namingSchemes[opts.Naming]; !ok {
+		return fmt.Errorf("unknown naming scheme %q", opts.Naming)
 	}
 
 	if flagSeed == "random" {
@@ -107,6 +152,18 @@ func setOptions() error {
 		opts.Seed = seed
 	}
 
+	if opts.MergePkgs != "" && opts.ShuffleFiles {
+		// The merged packages are initialized before the main package
+		// since their files come first, which -shufflefiles would undo.
+		return fmt.Errorf("-mergepkgs cannot be combined with -shufflefiles")
+	}
+
+	if opts.PrivateMethods && len(opts.Seed) == 0 {
+		// Without a seed, the new names would only depend on the package
+		// paths, which are no secret.
+		return fmt.Errorf("-privatemethods requires -seed")
+	}
+
 	if flagDebugDir != "" {
 		if !filepath.IsAbs(flagDebugDir) {
 			flagDebugDir = filepath.Join(wd, flagDebugDir)
@@ -143,16 +200,36 @@ type listedPackage struct {
 	Name       string
 	ImportPath string
 	Export     string
+	Imports    []string
 	Deps       []string
 	ImportMap  map[string]string
 
-	Dir     string
-	GoFiles []string
+	Dir           string
+	GoFiles       []string
+	CgoFiles      []string
+	SFiles        []string
+	EmbedPatterns []string
+
+	TestEmbedPatterns  []string
+	XTestEmbedPatterns []string
+
+	Module *listedModule
 
 	// TODO(mvdan): reuse this field once TOOLEXEC_IMPORTPATH is used
 	private bool
 }
 
+// listedModule contains the module information for a listed package, as
+// reported by 'go list -json'. Standard library packages have no module.
+type listedModule struct {
+	Path    string
+	Version string
+	Sum     string
+	Main    bool
+
+	Replace *listedModule
+}
+
 // setListedPackages gets information about the current package
 // and all of its dependencies
 func setListedPackages(patterns []string) error {
@@ -3,13 +3,39 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
 
 var globalVar = "global value"
 
 func globalFunc() { fmt.Println("global func body") }
 
+// literalsLoop uses a few literals in a loop, so that BenchmarkLiterals can
+// measure the cost of decoding them at run time.
+func literalsLoop(n int) int {
+	total := 0
+	for i := 0; i < n; i++ {
+		short := "short"
+		long := "a longer literal, which takes a bit more work to decode each time"
+		key := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+		var port uint16 = 8080
+		total += len(short) + len(long) + len(key) + int(port)
+	}
+	return total
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		n, err := strconv.Atoi(os.Args[1])
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(literalsLoop(n))
+		return
+	}
 	fmt.Println(globalVar)
 	globalFunc()
 }